@@ -0,0 +1,195 @@
+package protorpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/ragros/golang/protorpc/internal"
+)
+
+const cmdAuth = "/protorpc_auth"
+
+var (
+	ErrUnauthenticated = errors.New("Unauthenticated")
+	errAuthTimeout     = errors.New("authenticate timeout")
+)
+
+// 验证对端的身份凭证,返回对端的身份标识;nonce为本端在握手时下发的随机数
+type Authenticator interface {
+	Authenticate(c *Channel, nonce []byte, cred *Request) (principal string, err error)
+}
+
+type AuthenticatorFunc func(c *Channel, nonce []byte, cred *Request) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(c *Channel, nonce []byte, cred *Request) (string, error) {
+	return f(c, nonce, cred)
+}
+
+// 对端要求验证时,填写本端的身份凭证;nonce为对端下发的随机数
+type Credentials interface {
+	Credentials(c *Channel, nonce []byte, cred *Request) error
+}
+
+type CredentialsFunc func(c *Channel, nonce []byte, cred *Request) error
+
+func (f CredentialsFunc) Credentials(c *Channel, nonce []byte, cred *Request) error {
+	return f(c, nonce, cred)
+}
+
+func TokenCredentials(token string) Credentials {
+	return CredentialsFunc(func(c *Channel, nonce []byte, cred *Request) error {
+		cred.SetString("token", token)
+		return nil
+	})
+}
+
+func TokenAuthenticator(verify func(token string) (principal string, err error)) Authenticator {
+	return AuthenticatorFunc(func(c *Channel, nonce []byte, cred *Request) (string, error) {
+		token, err := cred.GetString("token")
+		if err != nil {
+			return "", ErrUnauthenticated
+		}
+		return verify(token)
+	})
+}
+
+// HMAC-SHA256挑战应答,密钥不在连接上传输
+func HMACCredentials(id string, key []byte) Credentials {
+	return CredentialsFunc(func(c *Channel, nonce []byte, cred *Request) error {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(nonce)
+		cred.SetString("id", id)
+		cred.SetBytes("mac", mac.Sum(nil))
+		return nil
+	})
+}
+
+func HMACAuthenticator(keyOf func(id string) ([]byte, bool)) Authenticator {
+	return AuthenticatorFunc(func(c *Channel, nonce []byte, cred *Request) (string, error) {
+		id, err := cred.GetString("id")
+		if err != nil {
+			return "", ErrUnauthenticated
+		}
+		sum, _ := cred.GetBytes("mac")
+		key, ok := keyOf(id)
+		if !ok {
+			return "", ErrUnauthenticated
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(nonce)
+		if !hmac.Equal(sum, mac.Sum(nil)) {
+			return "", ErrUnauthenticated
+		}
+		return id, nil
+	})
+}
+
+// 以对端TLS证书作为身份,verify为nil时以证书的CommonName作为身份标识
+func TLSAuthenticator(verify func(cert *x509.Certificate) (principal string, err error)) Authenticator {
+	return AuthenticatorFunc(func(c *Channel, nonce []byte, cred *Request) (string, error) {
+		certs := c.PeerCertificates()
+		if len(certs) == 0 {
+			return "", ErrUnauthenticated
+		}
+		if verify == nil {
+			return certs[0].Subject.CommonName, nil
+		}
+		return verify(certs[0])
+	})
+}
+
+// 验证通过后对端的身份标识
+func (c *Channel) Principal() string {
+	c.mux.Lock()
+	p := c.principal
+	c.mux.Unlock()
+	return p
+}
+
+func (c *Channel) resetAuth() {
+	c.mux.Lock()
+	c.principal = ""
+	c.nonce = nil
+	c.peerNonce = nil
+	c.authDone = make(chan error, 1)
+	c.mux.Unlock()
+	atomic.StoreInt32(&c.authed, 0)
+	if c.cfg.auth == nil {
+		atomic.StoreInt32(&c.authed, 1)
+		return
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	c.mux.Lock()
+	c.nonce = nonce
+	c.mux.Unlock()
+}
+
+func (c *Channel) authenticated() bool {
+	return atomic.LoadInt32(&c.authed) == 1
+}
+
+// 对端要求验证时发送本端凭证,本端要求验证时等待对端凭证
+func (c *Channel) authenticate() error {
+	c.mux.Lock()
+	peerNonce, done := c.peerNonce, c.authDone
+	c.mux.Unlock()
+	if peerNonce != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+		defer cancel()
+		req := NewRequest(cmdAuth)
+		if c.cfg.credentials != nil {
+			if err := c.cfg.credentials.Credentials(c, peerNonce, req); err != nil {
+				return err
+			}
+		}
+		if rsp := c.call(ctx, req); !rsp.IsOK() {
+			return errors.New(rsp.String())
+		}
+	}
+	if c.cfg.auth == nil {
+		return nil
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(HandshakeTimeout):
+		return errAuthTimeout
+	}
+}
+
+func (c *Channel) handleAuth(req *pb.Request) {
+	r := &Request{msg: req}
+	r.dp = r
+	if c.cfg.auth == nil {
+		c.writeResponse(NewResponse(r.ReqId(), Result_OK))
+		return
+	}
+	c.mux.Lock()
+	nonce, done := c.nonce, c.authDone
+	c.mux.Unlock()
+	principal, err := c.cfg.auth.Authenticate(c, nonce, r)
+	var rsp *Response
+	if err != nil {
+		rsp = NewResponse2(r.ReqId(), Result_INVALID_REQUEST, err.Error())
+	} else {
+		c.mux.Lock()
+		c.principal = principal
+		c.mux.Unlock()
+		atomic.StoreInt32(&c.authed, 1)
+		rsp = NewResponse(r.ReqId(), Result_OK)
+	}
+	if werr := c.writeResponse(rsp); werr != nil {
+		Logger.Error("write response error:", werr)
+	}
+	select {
+	case done <- err:
+	default:
+	}
+}
@@ -0,0 +1,151 @@
+package protorpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHMACAuth(t *testing.T) {
+	s := NewServer(nil)
+	s.SetAuthenticator(HMACAuthenticator(func(id string) ([]byte, bool) {
+		return []byte("k-" + id), id == "alice"
+	}))
+	s.HandleFunc("who", func(c *Channel, r *Request) *Response {
+		rsp := NewResponse(r.ReqId(), Result_OK)
+		rsp.SetString("p", c.Principal())
+		return rsp
+	})
+	addr := serve(t, s)
+	defer s.Stop()
+
+	c := connect(t, addr, func(c *Client) { c.SetCredentials(HMACCredentials("alice", []byte("k-alice"))) })
+	defer c.Close()
+	rsp := c.Execute(NewRequest("who"), 1000)
+	if p, _ := rsp.GetString("p"); p != "alice" {
+		t.Fatal(rsp)
+	}
+	for _, cred := range []Credentials{HMACCredentials("alice", []byte("wrong")), HMACCredentials("bob", []byte("k-bob")), nil} {
+		bad := NewClient(addr, 0, nil, nil)
+		if cred != nil {
+			bad.SetCredentials(cred)
+		}
+		if bad.Serve() {
+			t.Fatal("should fail")
+		}
+		bad.Close()
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	s := NewServer(nil)
+	s.SetAuthenticator(TokenAuthenticator(func(tk string) (string, error) {
+		if tk == "t1" {
+			return "u1", nil
+		}
+		return "", errors.New("bad token")
+	}))
+	addr := serve(t, s)
+	defer s.Stop()
+
+	c := connect(t, addr, func(c *Client) { c.SetCredentials(TokenCredentials("t1")) })
+	defer c.Close()
+	time.Sleep(20 * time.Millisecond)
+	if p := s.Channels()[0].Principal(); p != "u1" {
+		t.Fatal(p)
+	}
+	bad := NewClient(addr, 0, nil, nil)
+	bad.SetCredentials(TokenCredentials("t2"))
+	if bad.Serve() {
+		t.Fatal("should fail")
+	}
+	bad.Close()
+}
+
+// 验证前的请求只应答一次INVALID_REQUEST,随后断开连接
+func TestRequestBeforeAuth(t *testing.T) {
+	s := NewServer(nil)
+	s.SetAuthenticator(TokenAuthenticator(func(tk string) (string, error) { return tk, nil }))
+	handled := make(chan struct{}, 1)
+	s.HandleFunc("who", func(c *Channel, r *Request) *Response {
+		handled <- struct{}{}
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	addr := serve(t, s)
+	defer s.Stop()
+
+	got := make(chan *Response, 1)
+	c := NewClient(addr, 0, nil, nil)
+	c.SetCredentials(CredentialsFunc(func(ch *Channel, nonce []byte, cred *Request) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		got <- ch.call(ctx, NewRequest("who"))
+		cred.SetString("token", "t1")
+		return nil
+	}))
+	if c.Serve() {
+		t.Fatal("should fail")
+	}
+	defer c.Close()
+	if r := <-got; r.Result() != Result_INVALID_REQUEST || r.GetErrMsg() != ErrUnauthenticated.Error() {
+		t.Fatal(r)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := s.ChannelCount(); n != 0 {
+		t.Fatal("channel not closed:", n)
+	}
+	select {
+	case <-handled:
+		t.Fatal("handler called before auth")
+	default:
+	}
+}
+
+// 重连后验证完成前,用户请求不会发出
+func TestNoRequestsBeforeAuth(t *testing.T) {
+	s := NewServer(nil)
+	s.SetAuthenticator(TokenAuthenticator(func(tk string) (string, error) {
+		time.Sleep(100 * time.Millisecond)
+		return tk, nil
+	}))
+	s.HandleFunc("ping", func(c *Channel, r *Request) *Response { return NewResponse(r.ReqId(), Result_OK) })
+	addr := serve(t, s)
+	defer s.Stop()
+
+	c := NewClient(addr, 20, nil, nil)
+	c.SetCredentials(TokenCredentials("t1"))
+	if !c.Serve() {
+		t.Fatal("serve failed")
+	}
+	defer c.Close()
+
+	stop := make(chan struct{})
+	bad := make(chan *Response, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if r := c.Execute(NewRequest("ping"), 200); r.Result() == Result_INVALID_REQUEST {
+				bad <- r
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Channels()[0].Close()
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	select {
+	case r := <-bad:
+		t.Fatal("request sent before auth:", r)
+	default:
+	}
+	if r := c.Execute(NewRequest("ping"), 1000); !r.IsOK() {
+		t.Fatal(r)
+	}
+}
@@ -0,0 +1,167 @@
+package protorpc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+var (
+	ErrClientClosed = errors.New("client closed")
+	ErrGiveUp       = errors.New("max dial attempts reached")
+)
+
+// 重连退避:第n次失败后等待Base*Factor^n,不超过Max,再加减Jitter比例的随机抖动
+type Backoff struct {
+	Base        time.Duration
+	Max         time.Duration
+	Factor      float64
+	Jitter      float64 //0~1
+	MaxAttempts int     //连续失败多少次后放弃,0不限
+}
+
+func (b *Backoff) delay(attempt int) time.Duration {
+	d := float64(b.Base)
+	if b.Factor > 1 {
+		d *= math.Pow(b.Factor, float64(attempt))
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
+
+type ConnState int32
+
+const (
+	StateIdle       ConnState = iota //未启动或已放弃重连
+	StateConnecting                  //正在拨号及握手
+	StateReady                       //连接可用
+	StateBackoff                     //拨号失败,等待重试
+	StateClosed                      //已调用Close
+)
+
+var state_name = map[ConnState]string{
+	StateIdle:       "IDLE",
+	StateConnecting: "CONNECTING",
+	StateReady:      "READY",
+	StateBackoff:    "BACKOFF",
+	StateClosed:     "CLOSED",
+}
+
+func (s ConnState) String() string {
+	return state_name[s]
+}
+
+// SetBackoff时Base及Max未设置(<=0)所使用的值
+var DefaultBackoff = Backoff{Base: time.Second, Max: 2 * time.Minute}
+
+// 设置重连退避策略,覆盖redialMillis的固定间隔,需在Serve前调用
+func (c *Client) SetBackoff(b Backoff) {
+	if b.Base <= 0 {
+		b.Base = DefaultBackoff.Base
+	}
+	if b.Max <= 0 {
+		b.Max = DefaultBackoff.Max
+	}
+	c.backoff = b
+}
+
+// 连接状态变化时回调,需在Serve前调用
+func (c *Client) SetStateListener(fn func(ConnState)) {
+	c.onState = fn
+}
+
+func (c *Client) State() ConnState {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.state
+}
+
+// 等待连接可用;Client关闭或放弃重连时返回错误
+func (c *Client) WaitForReady(ctx context.Context) error {
+	for {
+		c.mux.Lock()
+		st, ch, err := c.state, c.stateCh, c.giveUp
+		c.mux.Unlock()
+		switch {
+		case st == StateReady:
+			return nil
+		case st == StateClosed:
+			return ErrClientClosed
+		case st == StateIdle && err != nil:
+			return err
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client) retry() bool {
+	return c.backoff.MaxAttempts != 1
+}
+
+// 放弃重连,切换到StateIdle,WaitForReady返回ErrGiveUp,离线队列中的消息不再发送;from为-1时不检查当前状态
+func (c *Client) abandon(from ConnState) {
+	c.mux.Lock()
+	cur := c.state
+	if cur == StateClosed || (from >= 0 && cur != from) {
+		c.mux.Unlock()
+		return
+	}
+	c.giveUp = ErrGiveUp
+	c.mux.Unlock()
+	if c.casState(cur, StateIdle) && c.outbox != nil {
+		c.outbox.drain(ErrGiveUp.Error())
+	}
+}
+
+// 关闭后只能由start切回StateIdle
+func (c *Client) setState(st ConnState) bool {
+	return c.casState(-1, st)
+}
+
+// from为-1时不检查当前状态
+func (c *Client) casState(from, to ConnState) bool {
+	c.mux.Lock()
+	cur := c.state
+	if (from >= 0 && cur != from) || (cur == StateClosed && to != StateIdle) || cur == to {
+		c.mux.Unlock()
+		return false
+	}
+	c.state = to
+	close(c.stateCh)
+	c.stateCh = make(chan struct{})
+	c.mux.Unlock()
+	if c.onState != nil {
+		c.onState(to)
+	}
+	return true
+}
+
+// 等待退避时间,期间被关闭返回false
+func (c *Client) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
+		c.mux.Lock()
+		st, ch := c.state, c.stateCh
+		c.mux.Unlock()
+		if st == StateClosed {
+			return false
+		}
+		select {
+		case <-t.C:
+			return true
+		case <-ch:
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package protorpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Base: 10 * time.Millisecond, Max: 50 * time.Millisecond, Factor: 2}
+	for i, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if d := b.delay(i); d != want*time.Millisecond {
+			t.Fatal(i, d)
+		}
+	}
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := b.delay(0); d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatal(d)
+		}
+	}
+}
+
+func TestSetBackoffDefaults(t *testing.T) {
+	c := NewClient("127.0.0.1:1", 0, nil, nil)
+	c.SetBackoff(Backoff{Factor: 2})
+	if c.backoff.Base != DefaultBackoff.Base || c.backoff.Max != DefaultBackoff.Max || c.backoff.Factor != 2 {
+		t.Fatal(c.backoff)
+	}
+}
+
+func TestReconnectState(t *testing.T) {
+	addr := freeAddr(t)
+	var mu sync.Mutex
+	var states []ConnState
+	c := NewClient(addr, 0, nil, nil)
+	c.SetBackoff(Backoff{Base: 10 * time.Millisecond, Max: 40 * time.Millisecond, Factor: 2, Jitter: 0.2})
+	readies := func() (n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, st := range states {
+			if st == StateReady {
+				n++
+			}
+		}
+		return
+	}
+	c.SetStateListener(func(s ConnState) {
+		mu.Lock()
+		states = append(states, s)
+		mu.Unlock()
+	})
+	c.ServeBG()
+	time.Sleep(100 * time.Millisecond)
+	if st := c.State(); st != StateBackoff && st != StateConnecting {
+		t.Fatal(st)
+	}
+
+	s := okServer()
+	ls, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ls)
+	defer s.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.WaitForReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.CloseAll()
+	waitFor(t, "reconnect", func() bool { return readies() == 2 })
+	if r := c.Execute(NewRequest("ping"), 1000); !r.IsOK() {
+		t.Fatal(r)
+	}
+
+	c.Close()
+	if err := c.WaitForReady(ctx); err != ErrClientClosed {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s.ChannelCount() != 0 {
+		t.Fatal("reconnected after close")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if states[0] != StateConnecting || states[len(states)-1] != StateClosed {
+		t.Fatal(states)
+	}
+}
+
+func TestBackoffGiveUp(t *testing.T) {
+	c := NewClient(freeAddr(t), 0, nil, nil)
+	c.SetBackoff(Backoff{Base: 5 * time.Millisecond, MaxAttempts: 3})
+	c.ServeBG()
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.WaitForReady(ctx); err != ErrGiveUp {
+		t.Fatal(err)
+	}
+	if st := c.State(); st != StateIdle {
+		t.Fatal(st)
+	}
+}
+
+// 不重连时断开即放弃,WaitForReady不会一直等待
+func TestGiveUpOnDisconnect(t *testing.T) {
+	s := NewServer(nil)
+	addr := serve(t, s)
+	defer s.Stop()
+	c := connect(t, addr)
+	defer c.Close()
+
+	s.CloseAll()
+	waitFor(t, "disconnect", func() bool { return c.State() != StateReady })
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.WaitForReady(ctx); err != ErrGiveUp {
+		t.Fatal(err)
+	}
+	if st := c.State(); st != StateIdle {
+		t.Fatal(st)
+	}
+}
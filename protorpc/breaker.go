@@ -0,0 +1,193 @@
+package protorpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type BreakerState int32
+
+const (
+	BreakerClosed   BreakerState = iota //正常放行
+	BreakerOpen                         //熔断,请求直接以Result_CIRCUIT_OPEN返回
+	BreakerHalfOpen                     //熔断超时后放行少量探测请求
+)
+
+var breaker_name = map[BreakerState]string{
+	BreakerClosed:   "CLOSED",
+	BreakerOpen:     "OPEN",
+	BreakerHalfOpen: "HALF_OPEN",
+}
+
+func (s BreakerState) String() string {
+	return breaker_name[s]
+}
+
+// 按命令熔断的策略
+type BreakerPolicy struct {
+	Failures    int           //连续失败多少次后熔断,0为1
+	OpenTimeout time.Duration //熔断多久后进入半开
+	HalfOpenMax int           //半开时允许同时进行的探测请求数,0为1
+	Results     []int32       //计为失败的结果码,为空时为TIMEOUT,QUEUE_FULL,SERVER_EXCEPTION
+}
+
+var defaultBreakerResults = []int32{Result_TIMEOUT, Result_QUEUE_FULL, Result_SERVER_EXCEPTION}
+
+type breaker struct {
+	cmd      string
+	policy   *BreakerPolicy
+	state    BreakerState
+	fails    int
+	probes   int
+	openedAt time.Time
+	mux      sync.Mutex
+}
+
+// 为cmd设置熔断策略,cmd为空时作用于未单独设置的命令(每个命令独立熔断),需在Serve前调用
+func (c *Client) SetCircuitBreaker(cmd string, p BreakerPolicy) {
+	if c.breakerPolicies == nil {
+		c.breakerPolicies = make(map[string]*BreakerPolicy)
+		c.breakers = make(map[string]*breaker)
+	}
+	c.breakerPolicies[cmd] = &p
+}
+
+// 熔断状态变化时回调,需在Serve前调用
+func (c *Client) SetBreakerListener(fn func(cmd string, state BreakerState)) {
+	c.onBreaker = fn
+}
+
+// 命令当前的熔断状态,未设置策略时为BreakerClosed
+func (c *Client) BreakerState(cmd string) BreakerState {
+	b := c.breaker(cmd)
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.state
+}
+
+func (c *Client) breaker(cmd string) *breaker {
+	if c.breakerPolicies == nil {
+		return nil
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if b, ok := c.breakers[cmd]; ok {
+		return b
+	}
+	p, ok := c.breakerPolicies[cmd]
+	if !ok {
+		if p, ok = c.breakerPolicies[""]; !ok {
+			return nil
+		}
+	}
+	b := &breaker{cmd: cmd, policy: p}
+	c.breakers[cmd] = b
+	return b
+}
+
+// 熔断打开时直接返回,否则执行并记录结果
+func (c *Client) executeBreaker(ctx context.Context, req *Request) *Response {
+	b := c.breaker(req.Cmd())
+	if b == nil {
+		return c.channel.ExecuteContext(ctx, req)
+	}
+	ok, st, changed := b.allow()
+	c.breakerChanged(b, st, changed)
+	if !ok {
+		return NewResponse2(req.ReqId(), Result_CIRCUIT_OPEN, "circuit open:"+req.Cmd())
+	}
+	rsp := c.channel.ExecuteContext(ctx, req)
+	st, changed = b.report(rsp.Result())
+	c.breakerChanged(b, st, changed)
+	return rsp
+}
+
+// st为变化时在锁内得到的新状态
+func (c *Client) breakerChanged(b *breaker, st BreakerState, changed bool) {
+	if !changed {
+		return
+	}
+	Logger.Warn("circuit breaker", b.cmd, st.String())
+	if c.onBreaker != nil {
+		c.onBreaker(b.cmd, st)
+	}
+}
+
+func (b *breaker) setState(st BreakerState) bool {
+	if b.state == st {
+		return false
+	}
+	b.state = st
+	if st == BreakerOpen {
+		b.openedAt = time.Now()
+	}
+	b.fails, b.probes = 0, 0
+	return true
+}
+
+func (b *breaker) allow() (ok bool, st BreakerState, changed bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.policy.OpenTimeout {
+			return false, b.state, false
+		}
+		changed = b.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		max := b.policy.HalfOpenMax
+		if max < 1 {
+			max = 1
+		}
+		if b.probes >= max {
+			return false, b.state, changed
+		}
+		b.probes++
+	}
+	return true, b.state, changed
+}
+
+// 调用方取消及链路断开的结果不计入成败
+func (b *breaker) report(result int32) (st BreakerState, changed bool) {
+	results := b.policy.Results
+	if len(results) == 0 {
+		results = defaultBreakerResults
+	}
+	failed := false
+	for _, r := range results {
+		if r == result {
+			failed = true
+			break
+		}
+	}
+	neutral := !failed && (result == Result_CLIENT_INTERRUPT || result == Result_LINK_BROKEN)
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		if failed {
+			b.fails++
+			if b.fails >= b.policy.Failures {
+				changed = b.setState(BreakerOpen)
+			}
+		} else if !neutral {
+			b.fails = 0
+		}
+	case BreakerHalfOpen:
+		if failed {
+			changed = b.setState(BreakerOpen)
+		} else if neutral {
+			if b.probes > 0 {
+				b.probes--
+			}
+		} else {
+			changed = b.setState(BreakerClosed)
+		}
+	}
+	return b.state, changed
+}
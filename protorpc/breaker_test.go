@@ -0,0 +1,102 @@
+package protorpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	s := NewServer(nil)
+	var slow int32 = 1
+	s.HandleContextFunc("x", func(ctx context.Context, c *Channel, r *Request) *Response {
+		if atomic.LoadInt32(&slow) == 1 {
+			<-ctx.Done()
+			return nil
+		}
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	var mu sync.Mutex
+	var events []BreakerState
+	c := connect(t, serve(t, s), func(c *Client) {
+		c.SetCircuitBreaker("", BreakerPolicy{Failures: 2, OpenTimeout: 100 * time.Millisecond})
+		c.SetBreakerListener(func(cmd string, st BreakerState) {
+			mu.Lock()
+			events = append(events, st)
+			mu.Unlock()
+		})
+	})
+	defer s.Stop()
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		if r := c.Execute(NewRequest("x"), 30); r.Result() != Result_TIMEOUT {
+			t.Fatal(r)
+		}
+	}
+	start := time.Now()
+	if r := c.Execute(NewRequest("x"), 1000); r.Result() != Result_CIRCUIT_OPEN || time.Since(start) > 10*time.Millisecond {
+		t.Fatal(r)
+	}
+	if c.BreakerState("x") != BreakerOpen || c.BreakerState("y") != BreakerClosed {
+		t.Fatal(c.BreakerState("x"), c.BreakerState("y"))
+	}
+	time.Sleep(120 * time.Millisecond)
+	atomic.StoreInt32(&slow, 0)
+	if r := c.Execute(NewRequest("x"), 1000); !r.IsOK() {
+		t.Fatal(r)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 3 || events[0] != BreakerOpen || events[1] != BreakerHalfOpen || events[2] != BreakerClosed {
+		t.Fatal(events)
+	}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	b := &breaker{cmd: "x", policy: &BreakerPolicy{OpenTimeout: 20 * time.Millisecond, HalfOpenMax: 2}}
+	// Failures为0时一次失败即熔断
+	if st, changed := b.report(Result_TIMEOUT); st != BreakerOpen || !changed {
+		t.Fatal(st)
+	}
+	if ok, _, _ := b.allow(); ok {
+		t.Fatal("allowed while open")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if ok, st, changed := b.allow(); !ok || st != BreakerHalfOpen || !changed {
+		t.Fatal(ok, st)
+	}
+	if ok, _, changed := b.allow(); !ok || changed {
+		t.Fatal("second probe")
+	}
+	if ok, _, _ := b.allow(); ok {
+		t.Fatal("probes exceed HalfOpenMax")
+	}
+	// 链路断开不计入成败,归还探测名额
+	if st, changed := b.report(Result_LINK_BROKEN); st != BreakerHalfOpen || changed {
+		t.Fatal(st)
+	}
+	if ok, _, _ := b.allow(); !ok {
+		t.Fatal("probe not released")
+	}
+	if st, changed := b.report(Result_SERVER_EXCEPTION); st != BreakerOpen || !changed {
+		t.Fatal(st)
+	}
+
+	b = &breaker{cmd: "y", policy: &BreakerPolicy{Failures: 2, Results: []int32{Result_LINK_BROKEN}}}
+	b.report(Result_LINK_BROKEN)
+	b.report(Result_OK)
+	if st, _ := b.report(Result_LINK_BROKEN); st != BreakerClosed {
+		t.Fatal("success did not reset failures")
+	}
+	// 未列出的结果码视为成功
+	b.report(Result_TIMEOUT)
+	if st, _ := b.report(Result_LINK_BROKEN); st != BreakerClosed {
+		t.Fatal("unlisted result counted")
+	}
+	if st, _ := b.report(Result_LINK_BROKEN); st != BreakerOpen {
+		t.Fatal(st)
+	}
+}
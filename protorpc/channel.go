@@ -1,15 +1,21 @@
 package protorpc
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/twinj/uuid"
 
 	pb "github.com/ragros/golang/protorpc/internal"
 )
@@ -18,30 +24,85 @@ var (
 	helloReq               = []byte{0xAA, 0, 0, 0}
 	helloRsp               = []byte{0xAA, 0, 0, 1}
 	frameMask         byte = 0xAA
+	frameFlagged      byte = 0xAB //帧体首字节为标志位,仅在协商后使用
+	fragMore          byte = 0x10 //分片,后续还有分片
+	fragLast          byte = 0x20 //最后一个分片
+	FragmentSize           = 1 << 20
+	MaxFrameSize           = 0xffffff //接收单帧的最大长度,握手时通知对端
 	HeartBeatDuration      = 180 * time.Second
+	ControlQueueSize       = 64 //readLoop中产生的待写消息(心跳、拒绝、流重置等)的最大数量,满时readLoop暂停读取
+)
+
+// 连接断开的原因,对端关闭时为io.EOF
+var (
+	ErrInvalidFrame     = errors.New("invalid frame")
+	ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+	ErrLocalClosed      = errors.New("closed by local")
 )
 
 type Channel struct {
 	conn     net.Conn
 	handlers map[string]Handler
+	cfg      *channelConfig
+	workers  *workers
 	rspCh    map[string]chan *Response
+	running  map[string]map[uint64]context.CancelFunc //重试或重放时同一req_id可能同时执行多次
+	runSeq   uint64
+	queues   map[string]*serialQueue
+	windows  map[string]*sendWindow
+	streams  map[string]*Stream
+	closed   map[string]struct{} //最近结束的流,忽略其迟到的帧
+	closedQ  []string
 	listener ChannelListener
 	header   []byte
 	valid    int32
+	ready    int32 //握手及验证完成,可以发送用户请求
+	goaway   int32 //对端通知不再接收新请求
+	inflight int32 //正在处理的请求数
+	leaving  int32 //已通知对端goaway,不再接收新请求
+	refused  int32 //已拒绝未验证的请求,等待断开
+	ctx      context.Context
+	cancel   context.CancelFunc
+	codec    *codec //发送时使用的压缩算法
+	peer     Capabilities
+	partial  []byte //接收中的分片
+	fragMux  sync.Mutex
+	ctrl     chan func() //readLoop不直接写,交由writeLoop按顺序写出
+	seq      uint64      //进程内唯一的通道编号
+	instance string      //握手时通知对端,Client重连时不变
+
+	principal string
+	nonce     []byte //本端下发的随机数,用于对端身份验证
+	peerNonce []byte
+	authed    int32
+	authDone  chan error
 
-	mux sync.Mutex
+	err    error   //断开原因
+	outbox *outbox //Client断线期间缓存待发送的请求
+	mux    sync.Mutex
 }
 
-func newChannel(hs map[string]Handler, listener ChannelListener) *Channel {
+func newChannel(hs map[string]Handler, cfg *channelConfig, listener ChannelListener) *Channel {
 	c := &Channel{
 		rspCh:    make(map[string]chan *Response),
+		running:  make(map[string]map[uint64]context.CancelFunc),
+		queues:   make(map[string]*serialQueue),
+		windows:  make(map[string]*sendWindow),
+		streams:  make(map[string]*Stream),
+		closed:   make(map[string]struct{}),
 		listener: listener,
 		handlers: hs,
+		cfg:      cfg,
+		workers:  newWorkers(cfg.concurrency, cfg.queueSize),
 		header:   make([]byte, 4),
+		seq:      atomic.AddUint64(&channelSeq, 1),
+		instance: uuid.Formatter(uuid.NewV4(), uuid.Clean),
 	}
 	return c
 }
 
+var channelSeq uint64
+
 func (c *Channel) RemoteAddr() string {
 	return c.conn.RemoteAddr().String()
 }
@@ -50,20 +111,50 @@ func (c *Channel) String() string {
 	return fmt.Sprintf("[%s]", c.conn.RemoteAddr().String())
 }
 
+// 非TLS连接时ok为false
+func (c *Channel) TLSState() (state tls.ConnectionState, ok bool) {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	if err := tc.Handshake(); err != nil {
+		return state, false
+	}
+	return tc.ConnectionState(), true
+}
+
+// 对端证书链,首个为对端自身的证书
+func (c *Channel) PeerCertificates() []*x509.Certificate {
+	state, ok := c.TLSState()
+	if !ok {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+// 握手及验证完成后为true
 func (c *Channel) IsValid() bool {
-	return atomic.LoadInt32(&c.valid) == 1
+	return atomic.LoadInt32(&c.ready) == 1
 }
 
-func (c *Channel) putRspChan(id string) (chan *Response, bool) {
+// 连接就绪且对端未通知goaway,可以发送新请求
+func (c *Channel) available() bool {
+	return atomic.LoadInt32(&c.ready) == 1 && atomic.LoadInt32(&c.goaway) == 0
+}
+
+// 与failPending在同一把锁下检查连接状态,断开后不再登记,避免等到超时
+func (c *Channel) putRspChan(id string, size int) (chan *Response, error) {
 	c.mux.Lock()
+	defer c.mux.Unlock()
+	if atomic.LoadInt32(&c.valid) != 1 {
+		return nil, ErrLinkBroken
+	}
 	if _, ok := c.rspCh[id]; ok {
-		c.mux.Unlock()
-		return nil, false
+		return nil, ErrDuplicateReqId
 	}
-	ch := make(chan *Response)
+	ch := make(chan *Response, size)
 	c.rspCh[id] = ch
-	c.mux.Unlock()
-	return ch, true
+	return ch, nil
 }
 
 func (c *Channel) remRspChan(id string) {
@@ -80,50 +171,205 @@ func (c *Channel) getRspChan(id string) (ch chan *Response, ok bool) {
 }
 
 func (c *Channel) Execute(req *Request, rspTimeout time.Duration) *Response {
-	if atomic.LoadInt32(&c.valid) != 1 {
+	ctx, cancel := context.WithTimeout(context.Background(), rspTimeout)
+	defer cancel()
+	return c.ExecuteContext(ctx, req)
+}
+
+// ctx结束时立即返回,并通知对端取消该请求
+func (c *Channel) ExecuteContext(ctx context.Context, req *Request) *Response {
+	if len(c.cfg.callInterceptors) == 0 {
+		return c.execute(ctx, c, req)
+	}
+	return chainInvoker(c.cfg.callInterceptors, c.execute)(ctx, c, req)
+}
+
+func (c *Channel) execute(ctx context.Context, _ *Channel, req *Request) *Response {
+	if c.outbox != nil && c.outbox.holdExecute(c, req) {
+		return c.outbox.execute(ctx, c, req)
+	}
+	if !c.available() {
 		return NewResponse(req.ReqId(), Result_LINK_BROKEN)
 	}
+	return c.call(ctx, req)
+}
+
+// 直接发送,不经过离线队列;握手及验证等内部请求使用
+func (c *Channel) call(ctx context.Context, req *Request) *Response {
+	if atomic.LoadInt32(&c.valid) != 1 || atomic.LoadInt32(&c.goaway) != 0 {
+		return NewResponse(req.ReqId(), Result_LINK_BROKEN)
+	}
+	ch, rsp := c.post(ctx, req)
+	if rsp != nil {
+		return rsp
+	}
+	return c.await(ctx, req, ch)
+}
+
+// 发送请求,返回等待响应的chan;失败时返回响应
+func (c *Channel) post(ctx context.Context, req *Request) (chan *Response, *Response) {
+	req.setDeadline(ctx)
 	bs, err := req.Marshal()
 	if err != nil {
-		return NewResponse2(req.ReqId(), Result_CLIENT_EXCEPTION, err.Error())
+		return nil, NewResponse2(req.ReqId(), Result_CLIENT_EXCEPTION, err.Error())
 	}
-	ch, ok := c.putRspChan(req.ReqId())
-	if !ok {
-		return NewResponse(req.ReqId(), Result_DUPLICATE_REQID)
+	ch, err := c.putRspChan(req.ReqId(), 1)
+	if err == ErrLinkBroken {
+		return nil, NewResponse(req.ReqId(), Result_LINK_BROKEN)
+	} else if err != nil {
+		return nil, NewResponse(req.ReqId(), Result_DUPLICATE_REQID)
 	}
 	err = c.Send(bs)
 	if err != nil {
 		c.remRspChan(req.ReqId())
-		return NewResponse2(req.ReqId(), Result_CLIENT_EXCEPTION, err.Error())
+		return nil, NewResponse2(req.ReqId(), Result_CLIENT_EXCEPTION, err.Error())
 	}
+	return ch, nil
+}
 
+func (c *Channel) await(ctx context.Context, req *Request, ch chan *Response) *Response {
 	select {
 	case m := <-ch:
 		c.remRspChan(req.ReqId())
 		return m
-	case <-time.After(rspTimeout):
+	case <-ctx.Done():
 		c.remRspChan(req.ReqId())
-		return NewResponse(req.ReqId(), Result_TIMEOUT)
+		if err := c.sendCancel(req.ReqId()); err != nil {
+			Logger.Warn("failed cancel request:", req.ReqId(), err)
+		}
+		return ctxResponse(req.ReqId(), ctx.Err())
+	}
+}
+
+func ctxResponse(reqId string, err error) *Response {
+	if err == context.DeadlineExceeded {
+		return NewResponse(reqId, Result_TIMEOUT)
+	}
+	return NewResponse2(reqId, Result_CLIENT_INTERRUPT, err.Error())
+}
+
+func (c *Channel) sendCancel(reqId string) error {
+	bs, err := proto.Marshal(&pb.Message{Cancel: &reqId})
+	if err != nil {
+		return err
 	}
+	return c.Send(bs)
 }
 
 func (c *Channel) Send(bd []byte) error {
-	if len(bd) > 0xffffff {
+	var flags byte
+	if cd := c.outCodec(); cd != nil && len(bd) >= CompressThreshold {
+		if zbs, err := cd.compress(bd); err == nil && len(zbs) < len(bd) {
+			bd = zbs
+			flags = cd.id
+		}
+	}
+	size := FragmentSize
+	if max := c.maxFrame() - 1; size > max {
+		size = max //分片需带标志位
+	}
+	if size < 1 {
+		size = 1
+	}
+	if len(bd) > size {
+		if max := c.PeerCapabilities().MaxMessage; max > 0 {
+			if int64(len(bd)) > max {
+				return fmt.Errorf("message over length")
+			}
+			return c.writeFragments(flags, bd, size)
+		}
+	}
+	return c.writeFrame(flags, bd)
+}
+
+// 对端可接收的单帧最大长度,握手前及旧版本对端为帧头可表示的最大值
+func (c *Channel) maxFrame() int {
+	if n := c.PeerCapabilities().MaxFrame; n > 0 && n < 0xffffff {
+		return n
+	}
+	return 0xffffff
+}
+
+// 同一时间只发送一个分片消息,每个分片单独写入,其他帧可穿插其间
+func (c *Channel) writeFragments(flags byte, bd []byte, size int) error {
+	c.fragMux.Lock()
+	defer c.fragMux.Unlock()
+	for len(bd) > 0 {
+		n := size
+		f := flags | fragMore
+		if len(bd) <= n {
+			n = len(bd)
+			f = flags | fragLast
+		}
+		if err := c.writeFrame(f, bd[:n]); err != nil {
+			return err
+		}
+		bd = bd[n:]
+	}
+	return nil
+}
+
+func (c *Channel) writeFrame(flags byte, bd []byte) error {
+	n := len(bd)
+	if flags != 0 {
+		n++
+	}
+	if n > c.maxFrame() {
 		return fmt.Errorf("frame over length")
 	}
-	dest := make([]byte, 4+len(bd))
-	binary.BigEndian.PutUint32(dest, uint32(len(bd)))
-	dest[0] = frameMask
-	copy(dest[4:], bd)
+	dest := make([]byte, 4+n)
+	binary.BigEndian.PutUint32(dest, uint32(n))
+	if flags == 0 {
+		dest[0] = frameMask
+		copy(dest[4:], bd)
+	} else {
+		dest[0] = frameFlagged
+		dest[4] = flags
+		copy(dest[5:], bd)
+	}
 	_, err := c.conn.Write(dest)
 	if err != nil {
-		c.conn.Close()
+		c.closeWith(err)
 	}
 	return err
 }
 
+func (c *Channel) outCodec() *codec {
+	c.mux.Lock()
+	cd := c.codec
+	c.mux.Unlock()
+	return cd
+}
+
 func (c *Channel) Notice(req *Request) (err error) {
-	if atomic.LoadInt32(&c.valid) != 1 {
+	if len(c.cfg.callInterceptors) == 0 {
+		return c.notice(req)
+	}
+	ctx := context.WithValue(context.Background(), noticeKey{}, true)
+	invoke := func(_ context.Context, _ *Channel, r *Request) *Response {
+		if err := c.notice(r); err != nil {
+			if err == ErrLinkBroken {
+				return NewResponse(r.ReqId(), Result_LINK_BROKEN)
+			}
+			if err == ErrQueueFull {
+				return NewResponse(r.ReqId(), Result_QUEUE_FULL)
+			}
+			return NewResponse2(r.ReqId(), Result_CLIENT_EXCEPTION, err.Error())
+		}
+		return nil
+	}
+	return responseError(chainInvoker(c.cfg.callInterceptors, invoke)(ctx, c, req))
+}
+
+func (c *Channel) notice(req *Request) (err error) {
+	if c.outbox != nil && c.outbox.holdNotice(c) {
+		return c.outbox.push(&outItem{req: req})
+	}
+	return c.sendNotice(req)
+}
+
+func (c *Channel) sendNotice(req *Request) (err error) {
+	if !c.available() {
 		err = ErrLinkBroken
 		return
 	}
@@ -136,8 +382,18 @@ func (c *Channel) Notice(req *Request) (err error) {
 	return
 }
 
+// 通知对端不再发送新请求
+func (c *Channel) sendGoaway() error {
+	atomic.StoreInt32(&c.leaving, 1)
+	bs, err := proto.Marshal(&pb.Message{Goaway: proto.Bool(true)})
+	if err != nil {
+		return err
+	}
+	return c.Send(bs)
+}
+
 func (c *Channel) writeResponse(rsp *Response) (err error) {
-	if !c.IsValid() {
+	if atomic.LoadInt32(&c.valid) != 1 {
 		err = ErrLinkBroken
 		return
 	}
@@ -166,34 +422,54 @@ func (c *Channel) readAtLeast(buf []byte, min int, timeout time.Time) (n int, er
 	return
 }
 
-func (c *Channel) readMessage() (body []byte, err error) {
+func (c *Channel) readFrame() (mark byte, body []byte, err error) {
 	var timeout bool
 	var lens int
 	timeLimit := time.Now().Add(HeartBeatDuration)
 	for {
 		_, err = c.readAtLeast(c.header, 4, timeLimit)
 		if err != nil {
-			operr, ok := err.(*net.OpError)
-			if !ok || !operr.Timeout() || timeout {
+			nerr, ok := err.(net.Error)
+			if !ok || !nerr.Timeout() {
 				return
 			}
-			if _, err = c.conn.Write(helloReq); err != nil {
-				Logger.Error("failed hello request:", c.conn.RemoteAddr().String(), err)
+			if timeout {
+				err = ErrHeartbeatTimeout
+				return
 			}
+			c.later(func() {
+				if _, err := c.conn.Write(helloReq); err != nil {
+					Logger.Error("failed hello request:", c.conn.RemoteAddr().String(), err)
+				}
+			})
 			timeout = true
 			continue
 		}
-		if c.header[0] != frameMask {
-			err = fmt.Errorf("invalid frame")
+		mark = c.header[0]
+		if mark != frameMask && mark != frameFlagged {
+			err = ErrInvalidFrame
 			return
 		}
 		c.header[0] = 0
 		timeout = false
 		lens = int(binary.BigEndian.Uint32(c.header))
-		if lens == 0 {
-			if _, err = c.conn.Write(helloRsp); err != nil {
-				Logger.Warn("failed hello response:", c.conn.RemoteAddr().String(), err)
+		if lens > MaxFrameSize {
+			err = fmt.Errorf("frame over length")
+			return
+		}
+		if mark == frameFlagged {
+			if lens == 0 {
+				err = ErrInvalidFrame
+				return
 			}
+			break
+		}
+		if lens == 0 {
+			c.later(func() {
+				if _, err := c.conn.Write(helloRsp); err != nil {
+					Logger.Warn("failed hello response:", c.conn.RemoteAddr().String(), err)
+				}
+			})
 			continue
 		} else if lens == 1 {
 			continue
@@ -205,37 +481,115 @@ func (c *Channel) readMessage() (body []byte, err error) {
 	return
 }
 
+// 分片的消息重组后返回,分片之间可穿插其他完整的帧
+func (c *Channel) readMessage() (body []byte, err error) {
+	for {
+		var mark byte
+		mark, body, err = c.readFrame()
+		if err != nil || mark != frameFlagged {
+			return
+		}
+		flags := body[0]
+		body = body[1:]
+		if flags&(fragMore|fragLast) != 0 {
+			if int64(len(c.partial)+len(body)) > MaxMessageSize {
+				err = fmt.Errorf("message over length")
+				return
+			}
+			c.partial = append(c.partial, body...)
+			if flags&fragMore != 0 {
+				continue
+			}
+			body, c.partial = c.partial, nil
+		}
+		if id := flags & 0x0f; id != 0 {
+			body, err = decompress(id, body)
+		}
+		return
+	}
+}
+
 func (c *Channel) readLoop() {
+	var err error
 	for {
-		bs, err := c.readMessage()
-		if err != nil {
+		var bs []byte
+		if bs, err = c.readMessage(); err != nil {
 			Logger.Error("channel read error:", err)
 			break
 		}
-		go c.marshalAndHandle(bs)
+		c.unmarshalAndDispatch(bs)
 	}
 	c.conn.Close()
 	atomic.StoreInt32(&c.valid, 0)
+	atomic.StoreInt32(&c.ready, 0)
+	c.mux.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	err = c.err
+	c.mux.Unlock()
+	c.failPending(err)
+	c.abortStreams()
+	c.mux.Lock()
+	c.cancel()
+	c.mux.Unlock()
 	if c.listener != nil {
 		c.listener.OnDisconnect(c)
 	}
 }
 
-func (c *Channel) marshalAndHandle(bs []byte) {
+func (c *Channel) unmarshalAndDispatch(bs []byte) {
 	msg := &pb.Message{}
 	if err := proto.Unmarshal(bs, msg); err != nil {
 		Logger.Warn("failed Unmarshal:", err)
 		return
 	}
 	if req := msg.GetRequest(); req != nil {
-		c.handle(req)
+		if atomic.LoadInt32(&c.refused) != 0 {
+			return //已拒绝未验证的请求,其后的验证也不再处理
+		}
+		switch req.GetCmd() {
+		case cmdHello:
+			c.handleHello(req)
+			return
+		case cmdAuth:
+			go c.handleAuth(req)
+			return
+		}
+		if !c.authenticated() {
+			rsp := NewResponse2(req.GetReqId(), Result_INVALID_REQUEST, ErrUnauthenticated.Error())
+			c.refuse(func() { c.writeResponse(rsp) })
+			return
+		}
+		c.dispatch(req)
+		return
+	}
+	if id := msg.GetCancel(); id != "" {
+		c.cancelRunning(id)
+		return
+	}
+	if f := msg.GetStream(); f != nil {
+		c.handleStreamFrame(f)
+		return
+	}
+	if win := msg.GetWindow(); win != nil {
+		c.addWindow(win.GetReqId(), win.GetCredit())
+		return
+	}
+	if msg.GetGoaway() {
+		Logger.Info("peer going away:", c.String())
+		atomic.StoreInt32(&c.goaway, 1)
 		return
 	}
 	if rsp := msg.GetResponse(); rsp != nil {
 		if ch, ok := c.getRspChan(rsp.GetReqId()); ok {
 			ack := &Response{msg: rsp}
 			ack.dp = ack
-			ch <- ack
+			select {
+			case ch <- ack:
+			default:
+				Logger.Warnf("drop duplicate response [%s]:%s", rsp.GetReqId(), c.String())
+			}
 		} else {
 			Logger.Warnf("drop unknown response [%s]:%s", rsp.GetReqId(), c.String())
 		}
@@ -243,14 +597,192 @@ func (c *Channel) marshalAndHandle(bs []byte) {
 
 }
 
-func (c *Channel) handle(req *pb.Request) {
-	r := &Request{msg: req}
+func (c *Channel) dispatch(req *pb.Request) {
+	// 先计数再检查leaving,Shutdown看到inflight为0后不会再有请求开始处理
+	atomic.AddInt32(&c.inflight, 1)
+	if atomic.LoadInt32(&c.leaving) != 0 {
+		atomic.AddInt32(&c.inflight, -1)
+		c.reject(req, NewResponse2(req.GetReqId(), Result_LINK_BROKEN, "server going away"))
+		return
+	}
+	if !c.workers.acquire() {
+		atomic.AddInt32(&c.inflight, -1)
+		c.reject(req, NewResponse(req.GetReqId(), Result_QUEUE_FULL))
+		return
+	}
+	if !c.cfg.shared.acquire() {
+		c.workers.release()
+		atomic.AddInt32(&c.inflight, -1)
+		c.reject(req, NewResponse(req.GetReqId(), Result_QUEUE_FULL))
+		return
+	}
+	ctx, cancel := c.requestContext(req)
+	job := func() {
+		defer atomic.AddInt32(&c.inflight, -1)
+		defer c.workers.release()
+		defer c.cfg.shared.release()
+		defer cancel()
+		if !c.workers.enter(ctx) {
+			return
+		}
+		defer c.workers.leave()
+		if !c.cfg.shared.enter(ctx) {
+			return
+		}
+		defer c.cfg.shared.leave()
+		if ctx.Err() != nil {
+			return
+		}
+		c.handle(ctx, req)
+	}
+	switch c.cfg.order {
+	case OrderChannel:
+		c.serialQueue("").push(job)
+	case OrderCommand:
+		key := req.GetCmd()
+		if _, ok := c.handlers[key]; !ok {
+			key = ""
+		}
+		c.serialQueue(key).push(job)
+	default:
+		go job()
+	}
+}
+
+func (c *Channel) serialQueue(key string) *serialQueue {
+	c.mux.Lock()
+	q, ok := c.queues[key]
+	if !ok {
+		q = &serialQueue{}
+		c.queues[key] = q
+	}
+	c.mux.Unlock()
+	return q
+}
+
+func (c *Channel) reject(req *pb.Request, rsp *Response) {
+	Logger.Warnf("reject [%s]%s %s:%s", req.GetReqId(), req.GetCmd(), result_name[rsp.Result()], c.String())
+	c.later(func() {
+		if err := c.writeResponse(rsp); err != nil {
+			Logger.Error("write response error:", err)
+		}
+	})
+}
+
+// 未验证时只回复第一个请求,随后断开连接
+func (c *Channel) refuse(write func()) {
+	if !atomic.CompareAndSwapInt32(&c.refused, 0, 1) {
+		return
+	}
+	Logger.Warn("unauthenticated request,close:", c.String())
+	c.later(func() {
+		write()
+		c.closeWith(ErrUnauthenticated)
+	})
+}
+
+// 在readLoop中调用,写操作交给writeLoop;积压时阻塞readLoop,不再读取对端的新请求
+func (c *Channel) later(fn func()) {
+	c.mux.Lock()
+	ch, ctx := c.ctrl, c.ctx
+	c.mux.Unlock()
+	select {
+	case ch <- fn:
+	case <-ctx.Done():
+	}
+}
+
+func (c *Channel) writeLoop(ctx context.Context, ch chan func()) {
+	for {
+		select {
+		case fn := <-ch:
+			fn()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Channel) putRunning(id string, cancel context.CancelFunc) (seq uint64) {
+	c.mux.Lock()
+	c.runSeq++
+	seq = c.runSeq
+	m, ok := c.running[id]
+	if !ok {
+		m = make(map[uint64]context.CancelFunc)
+		c.running[id] = m
+	}
+	m[seq] = cancel
+	c.mux.Unlock()
+	return
+}
+
+func (c *Channel) remRunning(id string, seq uint64) {
+	c.mux.Lock()
+	if m, ok := c.running[id]; ok {
+		delete(m, seq)
+		if len(m) == 0 {
+			delete(c.running, id)
+		}
+	}
+	c.mux.Unlock()
+}
+
+// 取消该req_id下所有正在执行的请求
+func (c *Channel) cancelRunning(id string) {
+	c.mux.Lock()
+	cancels := make([]context.CancelFunc, 0, len(c.running[id]))
+	for _, cancel := range c.running[id] {
+		cancels = append(cancels, cancel)
+	}
+	c.mux.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
+func (c *Channel) context() context.Context {
+	c.mux.Lock()
+	ctx := c.ctx
+	c.mux.Unlock()
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// 返回的cancel同时移除运行记录
+func (c *Channel) requestContext(req *pb.Request) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if t := req.GetTimeout(); t > 0 {
+		ctx, cancel = context.WithTimeout(c.context(), time.Duration(t)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(c.context())
+	}
+	id := req.GetReqId()
+	seq := c.putRunning(id, cancel)
+	return ctx, func() {
+		cancel()
+		c.remRunning(id, seq)
+	}
+}
+
+func (c *Channel) handle(ctx context.Context, req *pb.Request) {
+	r := &Request{msg: req, ctx: ctx}
 	r.dp = r
+	h, ok := c.handlers[req.GetCmd()]
+	if !ok {
+		h = notFoundHandler
+	}
+	if len(c.cfg.interceptors) > 0 {
+		h = chainHandler(c.cfg.interceptors, h)
+	}
 	var rsp *Response
-	if h, ok := c.handlers[req.GetCmd()]; ok {
-		rsp = h.Handle(c, r)
+	if c.cfg.idem != nil && req.GetWindow() == 0 {
+		rsp = c.cfg.idem.do(ctx, c.idemKey(req), func() *Response { return h.Handle(c, r) })
 	} else {
-		rsp = NewResponse2(r.ReqId(), Result_HANDLER_NOT_FOUND, req.GetCmd())
+		rsp = h.Handle(c, r)
 	}
 	if rsp == nil {
 		return
@@ -261,21 +793,90 @@ func (c *Channel) handle(req *pb.Request) {
 	}
 }
 
-func (c *Channel) serve(con net.Conn) {
+// 缓存按调用方隔离:有验证时为principal,否则为对端实例(重连后不变),旧版本的对端为通道
+func (c *Channel) idemKey(req *pb.Request) string {
+	owner := "#" + strconv.FormatUint(c.seq, 10)
+	if c.cfg.auth != nil {
+		owner = "@" + c.Principal()
+	} else if id := c.PeerCapabilities().Instance; id != "" {
+		owner = "%" + id
+	}
+	return owner + "/" + req.GetCmd() + "/" + req.GetReqId()
+}
+
+var notFoundHandler = HandlerFunc(func(c *Channel, r *Request) *Response {
+	return NewResponse2(r.ReqId(), Result_HANDLER_NOT_FOUND, r.Cmd())
+})
+
+func (c *Channel) serve(con net.Conn) error {
 	c.conn = con
+	c.mux.Lock()
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.ctrl = make(chan func(), ControlQueueSize)
+	go c.writeLoop(c.ctx, c.ctrl)
+	c.codec = nil
+	c.peer = Capabilities{}
+	c.partial = nil
+	c.err = nil
+	c.mux.Unlock()
+	atomic.StoreInt32(&c.goaway, 0)
+	atomic.StoreInt32(&c.leaving, 0)
+	atomic.StoreInt32(&c.refused, 0)
+	c.resetAuth()
 	if c.listener != nil {
 		c.listener.OnConnecting(c)
 	}
 	go c.readLoop()
 	atomic.StoreInt32(&c.valid, 1)
+	if err := c.handshake(); err != nil {
+		Logger.Error("handshake failed:", c.String(), err)
+		c.closeWith(err)
+		return err
+	}
+	if err := c.authenticate(); err != nil {
+		Logger.Error("authenticate failed:", c.String(), err)
+		c.closeWith(err)
+		return err
+	}
+	atomic.StoreInt32(&c.ready, 1)
 	if c.listener != nil {
 		c.listener.OnConnected(c)
 	}
-
+	return nil
 }
 
 func (c *Channel) Close() {
 	if c.conn != nil {
-		c.conn.Close()
+		c.closeWith(ErrLocalClosed)
+	}
+}
+
+// 记录断开原因后关闭连接,已有原因时不覆盖
+func (c *Channel) closeWith(err error) {
+	c.mux.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mux.Unlock()
+	c.conn.Close()
+}
+
+// 最近一次断开的原因(io.EOF,ErrInvalidFrame,ErrHeartbeatTimeout,ErrLocalClosed等),连接正常时为nil;
+// 在OnDisconnect中调用可得到本次断开的原因
+func (c *Channel) Err() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.err
+}
+
+// 连接断开时立即以LINK_BROKEN结束所有等待响应的请求
+func (c *Channel) failPending(cause error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for id, ch := range c.rspCh {
+		select {
+		case ch <- NewResponse2(id, Result_LINK_BROKEN, cause.Error()):
+		default:
+		}
 	}
 }
@@ -0,0 +1,179 @@
+package protorpc
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 在随机端口上启动服务端,返回监听地址
+func serve(t *testing.T, s *Server) string {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ls)
+	return ls.Addr().String()
+}
+
+// 不重连的客户端,configs在Serve前调用
+func connect(t *testing.T, addr string, configs ...func(*Client)) *Client {
+	c := NewClient(addr, 0, nil, nil)
+	for _, fn := range configs {
+		fn(c)
+	}
+	if !c.Serve() {
+		t.Fatal("connect failed:", addr)
+	}
+	return c
+}
+
+func TestExecuteContextCancelsHandler(t *testing.T) {
+	s := NewServer(nil)
+	seen := make(chan bool, 1)
+	s.HandleFunc("wait", func(c *Channel, r *Request) *Response {
+		select {
+		case <-r.Context().Done():
+			seen <- true
+		case <-time.After(3 * time.Second):
+			seen <- false
+		}
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if rsp := c.ExecuteContext(ctx, NewRequest("wait")); rsp.Result() != Result_CLIENT_INTERRUPT {
+		t.Fatal(rsp)
+	}
+	if !<-seen {
+		t.Fatal("handler not cancelled")
+	}
+}
+
+// 重用req_id时,前一次执行结束不能影响后一次的取消
+func TestCancelReusedReqId(t *testing.T) {
+	s := NewServer(nil)
+	var calls int32
+	seen := make(chan bool, 1)
+	s.HandleFunc("wait", func(c *Channel, r *Request) *Response {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(100 * time.Millisecond) //不理会取消
+			return nil
+		}
+		select {
+		case <-r.Context().Done():
+			seen <- true
+		case <-time.After(2 * time.Second):
+			seen <- false
+		}
+		return nil
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if rsp := c.ExecuteContext(ctx, NewRequest2("r1", "wait")); rsp.Result() != Result_TIMEOUT {
+		t.Fatal(rsp)
+	}
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel2)
+	if rsp := c.ExecuteContext(ctx2, NewRequest2("r1", "wait")); rsp.Result() != Result_CLIENT_INTERRUPT {
+		t.Fatal(rsp)
+	}
+	if !<-seen {
+		t.Fatal("second execution not cancelled")
+	}
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	s := NewServer(nil)
+	remain := make(chan time.Duration, 1)
+	gone := make(chan bool, 1)
+	s.HandleContextFunc("dl", func(ctx context.Context, c *Channel, r *Request) *Response {
+		d, _ := ctx.Deadline()
+		remain <- time.Until(d)
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	s.HandleContextFunc("long", func(ctx context.Context, c *Channel, r *Request) *Response {
+		select {
+		case <-ctx.Done():
+			gone <- true
+		case <-time.After(3 * time.Second):
+			gone <- false
+		}
+		return nil
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+
+	if rsp := c.Execute(NewRequest("dl"), 1500); !rsp.IsOK() {
+		t.Fatal(rsp)
+	}
+	if d := <-remain; d < time.Second || d > 1500*time.Millisecond {
+		t.Fatal(d)
+	}
+	c.Notice(NewRequest("long"))
+	time.Sleep(100 * time.Millisecond)
+	c.Close()
+	if !<-gone {
+		t.Fatal("handler not cancelled on disconnect")
+	}
+}
+
+func TestSetDeadlineClearsTimeout(t *testing.T) {
+	req := NewRequest("x")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req.setDeadline(ctx)
+	if req.msg.GetTimeout() <= 0 {
+		t.Fatal(req.msg.GetTimeout())
+	}
+	req.setDeadline(context.Background())
+	if req.msg.Timeout != nil {
+		t.Fatal(req.msg.GetTimeout())
+	}
+}
+
+// 分片发送的大消息不阻塞其间的小消息
+func TestFragmentedMessage(t *testing.T) {
+	FragmentSize = 64 << 10
+	defer func() { FragmentSize = 1 << 20 }()
+	s := NewServer(nil)
+	s.HandleFunc("echo", func(c *Channel, r *Request) *Response {
+		v, _ := r.GetBytes("v")
+		rsp := NewResponse(r.ReqId(), Result_OK)
+		rsp.SetBytes("v", v)
+		return rsp
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	big := make([]byte, 4<<20)
+	rand.Read(big)
+	done := make(chan *Response, 1)
+	go func() {
+		r := NewRequest("echo")
+		r.SetBytes("v", big)
+		done <- c.Execute(r, 10000)
+	}()
+	small := NewRequest("echo")
+	small.SetBytes("v", []byte("x"))
+	if rsp := c.Execute(small, 10000); !rsp.IsOK() {
+		t.Fatal(rsp)
+	}
+	rsp := <-done
+	if v, _ := rsp.GetBytes("v"); !bytes.Equal(v, big) {
+		t.Fatal("mismatch", rsp.Result())
+	}
+}
@@ -1,18 +1,40 @@
 package protorpc
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
+	"sync"
 	"time"
 )
 
 type Client struct {
-	addr      string
-	redial    time.Duration
+	addrs     []*AddrHealth
+	active    *AddrHealth
+	failback  time.Duration
+	onActive  func(addr string)
+	resolver  Resolver
+	resolved  <-chan struct{} //首次解析完成时关闭,拨号前等待
+	stop      context.CancelFunc
+	backoff   Backoff
+	state     ConnState
+	stateCh   chan struct{}
+	onState   func(ConnState)
+	giveUp    error
+	outbox    *outbox
+	retries   map[string]*RetryPolicy
+	mux       sync.Mutex
 	channel   *Channel
 	tlsConfig *tls.Config
+	reloader  *TlsReloader
+	dialer    func(addr string) (net.Conn, error)
 	handlers  map[string]Handler
+	cfg       channelConfig
 	listener  clientListener
+
+	breakerPolicies map[string]*BreakerPolicy
+	breakers        map[string]*breaker
+	onBreaker       func(cmd string, state BreakerState)
 }
 
 type clientListener struct {
@@ -22,12 +44,40 @@ type clientListener struct {
 
 //if reDial is zero,no retry
 func NewClient(svrAddr string, redialMillis int32, tlsCfg *tls.Config, listener ChannelListener) *Client {
+	return NewClientWithAddrs([]string{svrAddr}, redialMillis, tlsCfg, listener)
+}
+
+// svrAddrs按优先顺序排列,连接断开后依次尝试,连上非首选地址后定期探测并切回更优先的地址
+func NewClientWithAddrs(svrAddrs []string, redialMillis int32, tlsCfg *tls.Config, listener ChannelListener) *Client {
+	if len(svrAddrs) == 0 {
+		panic("no server address")
+	}
+	c := newClient(redialMillis, tlsCfg, listener)
+	for _, addr := range svrAddrs {
+		c.addrs = append(c.addrs, &AddrHealth{Addr: addr, Healthy: true})
+	}
+	return c
+}
+
+// 地址由resolver提供并随之更新,顺序即优先顺序
+func NewClientWithResolver(r Resolver, redialMillis int32, tlsCfg *tls.Config, listener ChannelListener) *Client {
+	c := newClient(redialMillis, tlsCfg, listener)
+	c.resolver = r
+	return c
+}
+
+func newClient(redialMillis int32, tlsCfg *tls.Config, listener ChannelListener) *Client {
+	redial := time.Duration(redialMillis) * time.Millisecond
 	c := &Client{
-		addr:      svrAddr,
-		redial:    time.Duration(redialMillis) * time.Millisecond,
+		failback:  DefaultFailback,
+		backoff:   Backoff{Base: redial, Max: redial},
+		stateCh:   make(chan struct{}),
 		tlsConfig: tlsCfg,
 		handlers:  make(map[string]Handler),
 	}
+	if redial == 0 {
+		c.backoff.MaxAttempts = 1
+	}
 	c.listener.listener = listener
 	c.listener.Client = c
 	return c
@@ -36,10 +86,13 @@ func NewClient(svrAddr string, redialMillis int32, tlsCfg *tls.Config, listener
 //if connect success , return true
 func (c *Client) Serve() bool {
 	if c.channel != nil {
+		c.setState(StateConnecting) //避免OnDisconnect再次重连
 		c.channel.Close()
 		<-time.After(100 * time.Millisecond)
 	}
-	c.channel = newChannel(c.handlers, &c.listener)
+	c.start()
+	c.channel = newChannel(c.handlers, &c.cfg, &c.listener)
+	c.channel.outbox = c.outbox
 	return c.dialLoop()
 }
 
@@ -47,12 +100,125 @@ func (c *Client) ServeBG() {
 	if c.channel != nil {
 		return
 	}
-	c.channel = newChannel(c.handlers, &c.listener)
+	c.start()
+	c.channel = newChannel(c.handlers, &c.cfg, &c.listener)
+	c.channel.outbox = c.outbox
 	go c.dialLoop()
 }
 
+func (c *Client) start() {
+	c.mux.Lock()
+	c.giveUp = nil
+	c.mux.Unlock()
+	c.setState(StateIdle)
+	if c.resolver != nil && c.stop == nil {
+		var ctx context.Context
+		ctx, c.stop = context.WithCancel(context.Background())
+		ch := watchResolver(ctx, c.resolver, c.setAddrs)
+		c.mux.Lock()
+		c.resolved = ch
+		c.mux.Unlock()
+	}
+}
+
+// 在dialLoop中等待resolver首次返回地址,最多ResolveTimeout,只等待一次
+func (c *Client) waitResolved() {
+	c.mux.Lock()
+	ch := c.resolved
+	c.resolved = nil
+	c.mux.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case <-ch:
+	case <-time.After(ResolveTimeout):
+		Logger.Warn("resolver not ready")
+	}
+}
+
+// 注册处理请求的拦截器,按注册顺序由外到内执行,需在Serve前调用
+func (c *Client) Intercept(its ...Interceptor) {
+	c.cfg.interceptors = append(c.cfg.interceptors, its...)
+}
+
+// 注册发送请求的拦截器,按注册顺序由外到内执行,需在Serve前调用
+func (c *Client) InterceptCall(its ...CallInterceptor) {
+	c.cfg.callInterceptors = append(c.cfg.callInterceptors, its...)
+}
+
+// 限制处理服务端请求的并发数及排队数,需在Serve前调用
+func (c *Client) SetLimit(concurrency, queueSize int) {
+	c.cfg.concurrency = concurrency
+	c.cfg.queueSize = queueSize
+}
+
+// 设置请求的处理顺序(OrderNone,OrderChannel,OrderCommand),需在Serve前调用
+func (c *Client) SetOrder(mode int) {
+	c.cfg.order = mode
+}
+
+// 记住window时长内最多maxEntries个(0不限)请求的响应,同一调用方相同req_id的重复请求直接返回缓存的响应,
+// 前一个仍在处理时等待其结果;调用方在有验证时为principal,否则为对端实例(重连后不变);
+// server stream请求不缓存,window<=0时关闭,需在Serve前调用
+func (c *Client) SetIdempotency(window time.Duration, maxEntries int) {
+	if window <= 0 {
+		c.cfg.idem = nil
+		return
+	}
+	c.cfg.idem = newIdemCache(window, maxEntries)
+}
+
+// 启用帧压缩,按优先顺序列出支持的算法(gzip,flate),连接时与对端协商,需在Serve前调用
+func (c *Client) SetCompression(codecs ...string) {
+	for _, name := range codecs {
+		if codecByName(name) == nil {
+			panic("unknown codec:" + name)
+		}
+	}
+	c.cfg.codecs = codecs
+}
+
+// 要求对端在OnConnected之前通过验证,未通过的连接被关闭,需在Serve前调用
+func (c *Client) SetAuthenticator(auth Authenticator) {
+	c.cfg.auth = auth
+}
+
+// 对端要求验证时提供的本端凭证,需在Serve前调用
+func (c *Client) SetCredentials(cred Credentials) {
+	c.cfg.credentials = cred
+}
+
+// 每次拨号时使用reloader当前的证书及ca,需在Serve前调用
+func (c *Client) SetTlsReloader(reloader *TlsReloader) {
+	c.reloader = reloader
+}
+
+// 自定义拨号,如unix socket,net.Pipe等;设置了tls时在返回的连接上进行tls握手,需在Serve前调用
+func (c *Client) SetDialer(dial func(addr string) (net.Conn, error)) {
+	c.dialer = dial
+}
+
 func (c *Client) Execute(req *Request, timeoutMills int) *Response {
-	return c.channel.Execute(req, time.Duration(timeoutMills)*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMills)*time.Millisecond)
+	defer cancel()
+	return c.ExecuteContext(ctx, req)
+}
+
+// 命令设置了重试策略时按策略重试,设置了熔断策略时熔断期间以Result_CIRCUIT_OPEN直接返回
+func (c *Client) ExecuteContext(ctx context.Context, req *Request) *Response {
+	if p := c.retryPolicy(req.Cmd()); p != nil && p.MaxAttempts > 1 {
+		return c.executeRetry(ctx, req, p)
+	}
+	return c.executeBreaker(ctx, req)
+}
+
+func (c *Client) ExecuteStream(ctx context.Context, req *Request) (*ResponseStream, error) {
+	return c.channel.ExecuteStream(ctx, req)
+}
+
+func (c *Client) OpenStream(cmd string) (*Stream, error) {
+	return c.channel.OpenStream(cmd)
 }
 
 func (c *Client) Notice(req *Request) (err error) {
@@ -73,37 +239,120 @@ func (c *Client) HandleFunc(cmd string, handler func(*Channel, *Request) *Respon
 	c.handlers[cmd] = HandlerFunc(handler)
 }
 
+func (c *Client) HandleContext(cmd string, handler ContextHandler) {
+	c.Handle(cmd, ctxHandler{handler})
+}
+
+func (c *Client) HandleContextFunc(cmd string, handler func(context.Context, *Channel, *Request) *Response) {
+	c.Handle(cmd, ctxHandler{ContextHandlerFunc(handler)})
+}
+
+func (c *Client) HandleServerStream(cmd string, handler ServerStreamHandler) {
+	c.Handle(cmd, streamHandler{handler})
+}
+
+func (c *Client) HandleServerStreamFunc(cmd string, handler func(context.Context, *Channel, *Request, *ResponseWriter) *Response) {
+	c.Handle(cmd, streamHandler{ServerStreamHandlerFunc(handler)})
+}
+
+func (c *Client) HandleStream(cmd string, handler StreamHandler) {
+	c.cfg.handleStream(cmd, handler)
+}
+
+func (c *Client) HandleStreamFunc(cmd string, handler func(*Stream)) {
+	c.cfg.handleStream(cmd, StreamHandlerFunc(handler))
+}
+
 //if connect success , return true
-func (c *Client) dialLoop() (succ bool) {
-	var err error
-	var conn net.Conn
-	for {
-		if c.tlsConfig != nil {
-			conn, err = tls.Dial("tcp", c.addr, c.tlsConfig)
-		} else {
-			conn, err = net.Dial("tcp", c.addr)
+func (c *Client) dialLoop() bool {
+	for attempt := 0; ; attempt++ {
+		if !c.setState(StateConnecting) && c.State() == StateClosed {
+			return false
 		}
+		c.waitResolved()
+		conn, a, err := c.dialAny()
 		if err == nil {
-			break
+			if c.State() == StateClosed {
+				conn.Close()
+				return false
+			}
+			c.setActive(a)
+			if err = c.channel.serve(conn); err == nil {
+				c.markOk(a)
+				if c.onActive != nil {
+					c.onActive(a.Addr)
+				}
+				if c.failback > 0 && len(c.preferred(a)) > 0 {
+					go c.probeLoop(c.channel.context(), a)
+				}
+				return true
+			}
+			c.markFail(a, err)
+		} else {
+			Logger.Error("connect to server failed:", err)
+		}
+		if c.backoff.MaxAttempts > 0 && attempt+1 >= c.backoff.MaxAttempts {
+			c.abandon(-1)
+			return false
 		}
-		Logger.Error("connect to server failed:", err)
-		if c.redial == 0 {
-			return
+		c.setState(StateBackoff)
+		if !c.sleep(c.backoff.delay(attempt)) {
+			return false
 		}
-		<-time.After(c.redial)
 	}
-	c.channel.serve(conn)
-	succ = true
-	return
 }
 
+func (c *Client) dial(addr string) (net.Conn, error) {
+	cfg := c.tlsConfig
+	if c.reloader != nil {
+		cfg = c.reloader.clientConfig(c.tlsConfig)
+	}
+	if c.dialer == nil {
+		if cfg != nil {
+			return tls.Dial("tcp", addr, cfg)
+		}
+		return net.Dial("tcp", addr)
+	}
+	conn, err := c.dialer(addr)
+	if err != nil || cfg == nil {
+		return conn, err
+	}
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			cfg.ServerName = host
+		} else {
+			cfg.ServerName = addr
+		}
+	}
+	tc := tls.Client(conn, cfg)
+	if err = tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// 关闭连接,不再重连
 func (c *Client) Close() {
+	c.setState(StateClosed)
+	if c.outbox != nil {
+		c.outbox.drain(ErrClientClosed.Error())
+	}
+	if c.stop != nil {
+		c.stop()
+		c.stop = nil
+	}
 	if c.channel != nil {
 		c.channel.Close()
 	}
 }
 
 func (c *clientListener) OnConnected(ch *Channel) {
+	c.setState(StateReady)
+	if c.outbox != nil {
+		go c.outbox.flush(ch)
+	}
 	if c.listener != nil {
 		c.listener.OnConnected(ch)
 	}
@@ -116,11 +365,22 @@ func (c *clientListener) OnDisconnect(ch *Channel) {
 	if c.listener != nil {
 		c.listener.OnDisconnect(ch)
 	}
-	if c.redial != 0 {
+	// 仅在已建立的连接断开时重连,拨号及握手失败由dialLoop自行重试
+	if !c.retry() {
+		c.abandon(StateReady)
+	} else if c.casState(StateReady, StateConnecting) {
 		go c.dialLoop()
 	}
 }
 
+// 最近一次断开的原因,连接正常时为nil
+func (c *Client) Err() error {
+	if c.channel != nil {
+		return c.channel.Err()
+	}
+	return nil
+}
+
 func (c *Client) IsValid() (ok bool) {
 	if c.channel != nil {
 		ok = c.channel.IsValid()
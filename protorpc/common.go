@@ -2,12 +2,14 @@ package protorpc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"log"
 	"os"
 	"reflect"
 	"strconv"
+	"time"
 	"unsafe"
 
 	"github.com/ragros/golang/logadapter"
@@ -29,6 +31,7 @@ const (
 	Result_LINK_BROKEN       int32 = 8
 	Result_HANDLER_NOT_FOUND int32 = 9
 	Result_INVALID_REQUEST   int32 = 10
+	Result_CIRCUIT_OPEN      int32 = 11
 )
 
 var (
@@ -50,6 +53,7 @@ var (
 		8:  "LINK_BROKEN",
 		9:  "HANDLER_NOT_FOUND",
 		10: "INVALID_REQUEST",
+		11: "CIRCUIT_OPEN",
 	}
 )
 
@@ -63,6 +67,25 @@ func (f HandlerFunc) Handle(c *Channel, r *Request) *Response {
 	return f(c, r)
 }
 
+// ctx携带调用方剩余的超时时间,对端取消请求或连接断开时被取消
+type ContextHandler interface {
+	HandleContext(context.Context, *Channel, *Request) *Response
+}
+
+type ContextHandlerFunc func(context.Context, *Channel, *Request) *Response
+
+func (f ContextHandlerFunc) HandleContext(ctx context.Context, c *Channel, r *Request) *Response {
+	return f(ctx, c, r)
+}
+
+type ctxHandler struct {
+	ContextHandler
+}
+
+func (h ctxHandler) Handle(c *Channel, r *Request) *Response {
+	return h.HandleContext(r.Context(), c, r)
+}
+
 /**
 连接建立后,优先发送数据的一方,可以在OnConnected中发送请求。
 另一方可在OnConnecting时保存连接信息方便数据来临时找到对应的通道。
@@ -88,6 +111,7 @@ type dataOper struct {
 type Request struct {
 	dataOper
 	msg *pb.Request
+	ctx context.Context
 }
 
 func NewRequest(cmd string) *Request {
@@ -139,6 +163,14 @@ func (t *Request) Cmd() string {
 	return t.msg.GetCmd()
 }
 
+// 服务端处理请求时,对端取消请求,超时或连接断开后ctx被取消
+func (t *Request) Context() context.Context {
+	if t.ctx != nil {
+		return t.ctx
+	}
+	return context.Background()
+}
+
 func (t *dataOper) SetString(key string, value string) {
 	en := t.dp.entity(key)
 	if en == nil {
@@ -409,6 +441,20 @@ func (t *dataOper) GetJsonObject(key string, out interface{}) error {
 	return js.Decode(out)
 }
 
+// 将ctx的剩余时间随请求发送给对端
+func (t *Request) setDeadline(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.msg.Timeout = nil //重发时清除上次调用留下的超时
+		return
+	}
+	remain := int64(deadline.Sub(time.Now()) / time.Millisecond)
+	if remain < 1 {
+		remain = 1
+	}
+	t.msg.Timeout = &remain
+}
+
 func (t *Request) Marshal() ([]byte, error) {
 	en := &pb.Message{
 		Request: t.msg,
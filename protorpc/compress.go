@@ -0,0 +1,115 @@
+package protorpc
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	CompressThreshold       = 1024     //小于该长度的帧不压缩
+	MaxMessageSize    int64 = 64 << 20 //解压或重组后消息的最大长度
+)
+
+// 压缩帧在头部之后带一个标志字节,低4位为压缩算法编号
+type codec struct {
+	id         byte
+	name       string
+	compress   func([]byte) ([]byte, error)
+	decompress func(io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = []*codec{
+	{
+		id:   1,
+		name: "gzip",
+		compress: func(bs []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			if _, err := w.Write(bs); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		id:   2,
+		name: "flate",
+		compress: func(bs []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			w, err := flate.NewWriter(&buf, flate.BestSpeed)
+			if err != nil {
+				return nil, err
+			}
+			if _, err = w.Write(bs); err != nil {
+				return nil, err
+			}
+			if err = w.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	},
+}
+
+func codecByName(name string) *codec {
+	for _, cd := range codecs {
+		if cd.name == name {
+			return cd
+		}
+	}
+	return nil
+}
+
+func codecById(id byte) *codec {
+	for _, cd := range codecs {
+		if cd.id == id {
+			return cd
+		}
+	}
+	return nil
+}
+
+func decompress(id byte, bs []byte) ([]byte, error) {
+	cd := codecById(id)
+	if cd == nil {
+		return nil, fmt.Errorf("unknown codec:%d", id)
+	}
+	r, err := cd.decompress(bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, MaxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > MaxMessageSize {
+		return nil, fmt.Errorf("message over length")
+	}
+	return out, nil
+}
+
+// 按本端的优先顺序选择双方都支持的压缩算法
+func negotiateCodec(local, remote []string) *codec {
+	for _, name := range local {
+		for _, v := range remote {
+			if v == name {
+				return codecByName(name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package protorpc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	src := bytes.Repeat([]byte("hello world "), 1000)
+	for _, cd := range codecs {
+		zbs, err := cd.compress(src)
+		if err != nil {
+			t.Fatal(cd.name, err)
+		}
+		if len(zbs) >= len(src) {
+			t.Fatal(cd.name, "not compressed")
+		}
+		out, err := decompress(cd.id, zbs)
+		if err != nil || !bytes.Equal(out, src) {
+			t.Fatal(cd.name, err)
+		}
+	}
+	if _, err := decompress(0x0f, src); err == nil {
+		t.Fatal("unknown codec accepted")
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	if cd := negotiateCodec([]string{"flate", "gzip"}, []string{"gzip", "flate"}); cd == nil || cd.name != "flate" {
+		t.Fatal(cd)
+	}
+	if cd := negotiateCodec([]string{"gzip"}, nil); cd != nil {
+		t.Fatal(cd.name)
+	}
+}
+
+func TestCompressedExchange(t *testing.T) {
+	s := NewServer(nil)
+	s.SetCompression("flate", "gzip")
+	s.HandleFunc("echo", func(c *Channel, r *Request) *Response {
+		v, _ := r.GetString("v")
+		rsp := NewResponse(r.ReqId(), Result_OK)
+		rsp.SetString("v", v)
+		return rsp
+	})
+	addr := serve(t, s)
+	defer s.Stop()
+
+	big := strings.Repeat("hello world ", 10000)
+	for _, cs := range [][]string{{"gzip"}, nil} {
+		c := connect(t, addr, func(c *Client) { c.SetCompression(cs...) })
+		cd := c.channel.outCodec()
+		if len(cs) > 0 && (cd == nil || cd.name != "gzip") {
+			t.Fatal("codec not negotiated:", cs)
+		}
+		if len(cs) == 0 && cd != nil {
+			t.Fatal("unexpected codec:", cd.name)
+		}
+		r := NewRequest("echo")
+		r.SetString("v", big)
+		rsp := c.Execute(r, 2000)
+		if v, _ := rsp.GetString("v"); v != big {
+			t.Fatal("mismatch", rsp.Result())
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,80 @@
+package protorpc
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+type causeListener chan error
+
+func (l causeListener) OnConnecting(*Channel)   {}
+func (l causeListener) OnConnected(*Channel)    {}
+func (l causeListener) OnDisconnect(c *Channel) { l <- c.Err() }
+
+func TestFailPendingOnDisconnect(t *testing.T) {
+	s := NewServer(nil)
+	block := make(chan struct{})
+	defer close(block)
+	s.HandleFunc("slow", func(c *Channel, r *Request) *Response {
+		<-block
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	addr := serve(t, s)
+	defer s.Stop()
+	l := make(causeListener, 1)
+	c := NewClient(addr, 0, nil, l)
+	if !c.Serve() {
+		t.Fatal("serve failed")
+	}
+	defer c.Close()
+
+	done := make(chan *Response)
+	go func() { done <- c.Execute(NewRequest("slow"), 10000) }()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	s.CloseAll()
+	if r := <-done; r.Result() != Result_LINK_BROKEN || time.Since(start) > time.Second {
+		t.Fatal(r, time.Since(start))
+	}
+	if err := <-l; err != io.EOF {
+		t.Fatal(err)
+	}
+	if err := c.Err(); err != io.EOF {
+		t.Fatal(err)
+	}
+	// 断开后发出的请求立即失败,不等待超时
+	start = time.Now()
+	if r := c.Execute(NewRequest("slow"), 10000); r.Result() != Result_LINK_BROKEN || time.Since(start) > time.Second {
+		t.Fatal(r, time.Since(start))
+	}
+}
+
+func TestDisconnectCause(t *testing.T) {
+	s := NewServer(nil)
+	addr := serve(t, s)
+	defer s.Stop()
+	l := make(causeListener, 1)
+
+	c := NewClient(addr, 0, nil, l)
+	if !c.Serve() {
+		t.Fatal("serve failed")
+	}
+	c.Close()
+	if err := <-l; err != ErrLocalClosed {
+		t.Fatal(err)
+	}
+
+	c = NewClient(addr, 0, nil, l)
+	if !c.Serve() {
+		t.Fatal("serve failed")
+	}
+	defer c.Close()
+	time.Sleep(20 * time.Millisecond)
+	for _, ch := range s.Channels() {
+		ch.conn.Write([]byte{0x11, 0, 0, 0})
+	}
+	if err := <-l; err != ErrInvalidFrame {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,204 @@
+package protorpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 连上非首选地址后探测更优先地址的默认间隔
+var DefaultFailback = 30 * time.Second
+
+// 切回首选地址前等待当前连接上的请求完成的最长时间
+var FailbackDrain = 10 * time.Second
+
+type AddrHealth struct {
+	Addr     string
+	Healthy  bool
+	Fails    int       //连续失败次数
+	LastErr  error     //最近一次失败的原因
+	LastSeen time.Time //最近一次连接成功的时间
+}
+
+// 设置切回首选地址的探测间隔,0表示不切回,需在Serve前调用
+func (c *Client) SetFailback(interval time.Duration) {
+	c.failback = interval
+}
+
+// 连接建立后回调当前使用的地址,需在Serve前调用
+func (c *Client) SetActiveAddrListener(fn func(addr string)) {
+	c.onActive = fn
+}
+
+// 当前使用的地址,未曾连接时返回空串
+func (c *Client) ActiveAddr() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.active == nil {
+		return ""
+	}
+	return c.active.Addr
+}
+
+// 按优先顺序返回各地址的健康状态
+func (c *Client) Health() []AddrHealth {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	hs := make([]AddrHealth, len(c.addrs))
+	for i, a := range c.addrs {
+		hs[i] = *a
+	}
+	return hs
+}
+
+// 替换地址列表,保留已有地址的健康状态;当前地址被移除时断开,由重连选择新地址
+func (c *Client) setAddrs(addrs []string) {
+	c.mux.Lock()
+	old := make(map[string]*AddrHealth, len(c.addrs))
+	for _, a := range c.addrs {
+		old[a.Addr] = a
+	}
+	list := make([]*AddrHealth, 0, len(addrs))
+	removed := c.active != nil
+	for _, addr := range addrs {
+		a, ok := old[addr]
+		if !ok {
+			a = &AddrHealth{Addr: addr, Healthy: true}
+		}
+		if a == c.active {
+			removed = false
+		}
+		list = append(list, a)
+	}
+	c.addrs = list
+	active := c.active
+	c.mux.Unlock()
+	if removed && c.channel != nil && c.channel.IsValid() {
+		Logger.Info("active address removed:", active.Addr)
+		c.channel.Close()
+	}
+}
+
+// 健康的地址按优先顺序在前,失败过的在后
+func (c *Client) dialOrder() []*AddrHealth {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	order := make([]*AddrHealth, 0, len(c.addrs))
+	for _, a := range c.addrs {
+		if a.Healthy {
+			order = append(order, a)
+		}
+	}
+	for _, a := range c.addrs {
+		if !a.Healthy {
+			order = append(order, a)
+		}
+	}
+	return order
+}
+
+// 比a优先的地址
+func (c *Client) preferred(a *AddrHealth) []*AddrHealth {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for i, b := range c.addrs {
+		if b == a {
+			return append([]*AddrHealth(nil), c.addrs[:i]...)
+		}
+	}
+	return nil
+}
+
+func (c *Client) dialAny() (conn net.Conn, a *AddrHealth, err error) {
+	for _, a = range c.dialOrder() {
+		if conn, err = c.dial(a.Addr); err == nil {
+			return
+		}
+		Logger.Warn("connect to", a.Addr, "failed:", err)
+		c.markFail(a, err)
+	}
+	if err == nil {
+		err = errors.New("no server address")
+	}
+	return
+}
+
+func (c *Client) setActive(a *AddrHealth) {
+	c.mux.Lock()
+	c.active = a
+	c.mux.Unlock()
+}
+
+func (c *Client) markOk(a *AddrHealth) {
+	c.mux.Lock()
+	a.Healthy = true
+	a.Fails = 0
+	a.LastSeen = time.Now()
+	c.mux.Unlock()
+}
+
+func (c *Client) markFail(a *AddrHealth, err error) {
+	c.mux.Lock()
+	a.Healthy = false
+	a.Fails++
+	a.LastErr = err
+	c.mux.Unlock()
+}
+
+// 连接在非首选地址上时定期探测更优先的地址,可用则等待请求完成后断开当前连接,由重连切回
+func (c *Client) probeLoop(ctx context.Context, a *AddrHealth) {
+	if !c.retry() {
+		return
+	}
+	t := time.NewTicker(c.failback)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for _, p := range c.preferred(a) {
+			conn, err := c.dial(p.Addr)
+			if err != nil {
+				c.markFail(p, err)
+				continue
+			}
+			conn.Close()
+			c.markOk(p)
+			if ctx.Err() != nil {
+				return
+			}
+			Logger.Info("fail back to", p.Addr)
+			c.channel.drain(ctx, FailbackDrain)
+			if ctx.Err() != nil {
+				return
+			}
+			c.channel.Close()
+			return
+		}
+	}
+}
+
+// 不再发送新请求,等待已发出的请求及流结束,最多等待timeout
+func (c *Channel) drain(ctx context.Context, timeout time.Duration) {
+	atomic.StoreInt32(&c.goaway, 1)
+	deadline := time.Now().Add(timeout)
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for time.Now().Before(deadline) {
+		c.mux.Lock()
+		n := len(c.rspCh) + len(c.streams)
+		c.mux.Unlock()
+		if n == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
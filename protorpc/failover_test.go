@@ -0,0 +1,148 @@
+package protorpc
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+	return ls.Addr().String()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout:", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func okServer() *Server {
+	s := NewServer(nil)
+	s.HandleFunc("ping", func(c *Channel, r *Request) *Response { return NewResponse(r.ReqId(), Result_OK) })
+	return s
+}
+
+func TestFailoverAndFailback(t *testing.T) {
+	primary := freeAddr(t)
+	sec := okServer()
+	secondary := serve(t, sec)
+	defer sec.Stop()
+
+	var mu sync.Mutex
+	var got []string
+	actives := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), got...)
+	}
+	c := NewClientWithAddrs([]string{primary, secondary}, 50, nil, nil)
+	c.SetFailback(100 * time.Millisecond)
+	c.SetActiveAddrListener(func(a string) {
+		mu.Lock()
+		got = append(got, a)
+		mu.Unlock()
+	})
+	if !c.Serve() {
+		t.Fatal("serve failed")
+	}
+	defer c.Close()
+	if a := c.ActiveAddr(); a != secondary {
+		t.Fatal(a)
+	}
+	if h := c.Health(); h[0].Healthy || h[0].Fails == 0 || h[0].LastErr == nil || !h[1].Healthy {
+		t.Fatal(h)
+	}
+
+	pri := okServer()
+	ls, err := net.Listen("tcp", primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go pri.ServeListener(ls)
+	waitFor(t, "failback", func() bool { return len(actives()) == 2 })
+	if a := actives(); a[0] != secondary || a[1] != primary || c.ActiveAddr() != primary {
+		t.Fatal(a)
+	}
+	if r := c.Execute(NewRequest("ping"), 1000); !r.IsOK() {
+		t.Fatal(r)
+	}
+
+	pri.Stop()
+	pri.CloseAll()
+	waitFor(t, "failover", func() bool { return len(actives()) == 3 })
+	if a := actives(); a[2] != secondary {
+		t.Fatal(a)
+	}
+}
+
+// 已连在首选地址上时不再探测
+func TestNoProbeOnPreferred(t *testing.T) {
+	s1, s2 := okServer(), okServer()
+	a1, a2 := serve(t, s1), serve(t, s2)
+	defer s1.Stop()
+	defer s2.Stop()
+
+	var dials int32
+	c := NewClientWithAddrs([]string{a1, a2}, 50, nil, nil)
+	c.SetFailback(20 * time.Millisecond)
+	c.SetDialer(func(addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial("tcp", addr)
+	})
+	if !c.Serve() {
+		t.Fatal("serve failed")
+	}
+	defer c.Close()
+	time.Sleep(150 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != 1 || c.ActiveAddr() != a1 {
+		t.Fatal(n, c.ActiveAddr())
+	}
+}
+
+// 切回首选地址前等待当前连接上的请求完成
+func TestFailbackDrain(t *testing.T) {
+	primary := freeAddr(t)
+	sec := okServer()
+	sec.HandleFunc("slow", func(c *Channel, r *Request) *Response {
+		time.Sleep(300 * time.Millisecond)
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	secondary := serve(t, sec)
+	defer sec.Stop()
+
+	c := NewClientWithAddrs([]string{primary, secondary}, 50, nil, nil)
+	c.SetFailback(50 * time.Millisecond)
+	if !c.Serve() {
+		t.Fatal("serve failed")
+	}
+	defer c.Close()
+
+	done := make(chan *Response, 1)
+	go func() { done <- c.Execute(NewRequest("slow"), 2000) }()
+	time.Sleep(20 * time.Millisecond)
+	pri := okServer()
+	ls, err := net.Listen("tcp", primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go pri.ServeListener(ls)
+	defer pri.Stop()
+	if r := <-done; !r.IsOK() {
+		t.Fatal(r)
+	}
+	waitFor(t, "failback", func() bool { return c.ActiveAddr() == primary && c.IsValid() })
+	if r := c.Execute(NewRequest("ping"), 1000); !r.IsOK() {
+		t.Fatal(r)
+	}
+}
@@ -0,0 +1,107 @@
+package protorpc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pb "github.com/ragros/golang/protorpc/internal"
+)
+
+const (
+	ProtocolVersion = 1
+	cmdHello        = "/protorpc_hello"
+)
+
+var HandshakeTimeout = 5 * time.Second
+
+// 握手时对端声明的能力
+type Capabilities struct {
+	Version    int      //协议版本,0表示对端为不支持握手的旧版本
+	Codecs     []string //支持的压缩算法
+	MaxFrame   int      //单帧的最大长度
+	MaxMessage int64    //可重组的最大消息长度,0表示不支持分片
+	Auth       bool     //对端要求身份验证
+	Instance   string   //对端实例的标识,同一Client重连后不变
+}
+
+func (c *Channel) PeerCapabilities() Capabilities {
+	c.mux.Lock()
+	peer := c.peer
+	c.mux.Unlock()
+	return peer
+}
+
+// 在OnConnected之前交换双方的协议版本及能力,
+// 旧版本的对端返回HANDLER_NOT_FOUND,按版本0处理:不压缩,不分片
+func (c *Channel) handshake() error {
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	req := NewRequest(cmdHello)
+	c.fillHello(&req.dataOper)
+	rsp := c.call(ctx, req)
+	switch rsp.Result() {
+	case Result_OK:
+		c.setPeerHello(&rsp.dataOper)
+		return nil
+	case Result_HANDLER_NOT_FOUND:
+		Logger.Info("peer handshake unsupported:", c.String())
+		return nil
+	}
+	return errors.New(rsp.String())
+}
+
+func (c *Channel) fillHello(d *dataOper) {
+	d.SetInt64("version", ProtocolVersion)
+	d.SetStringList("codecs", c.cfg.codecs)
+	d.SetInt64("max_frame", int64(MaxFrameSize))
+	d.SetInt64("max_message", MaxMessageSize)
+	d.SetString("instance", c.instance)
+	c.mux.Lock()
+	nonce := c.nonce
+	c.mux.Unlock()
+	if nonce != nil {
+		d.SetBool("auth", true)
+		d.SetBytes("nonce", nonce)
+	}
+}
+
+func (c *Channel) handleHello(req *pb.Request) {
+	r := &Request{msg: req}
+	r.dp = r
+	rsp := NewResponse(r.ReqId(), Result_OK)
+	c.fillHello(&rsp.dataOper)
+	bs, err := rsp.marshal()
+	if err != nil {
+		Logger.Error("failed marshal hello:", err)
+		return
+	}
+	// 应答需在协商结果生效前生成,以不压缩的帧发送
+	c.later(func() {
+		if err := c.writeFrame(0, bs); err != nil {
+			Logger.Error("write response error:", err)
+		}
+	})
+	c.setPeerHello(&r.dataOper)
+}
+
+func (c *Channel) setPeerHello(d *dataOper) {
+	var peer Capabilities
+	version, _ := d.GetInt64("version")
+	maxFrame, _ := d.GetInt64("max_frame")
+	peer.Version = int(version)
+	peer.MaxFrame = int(maxFrame)
+	peer.Codecs, _ = d.GetStringList("codecs")
+	peer.MaxMessage, _ = d.GetInt64("max_message")
+	peer.Auth, _ = d.GetBool("auth")
+	peer.Instance, _ = d.GetString("instance")
+	nonce, _ := d.GetBytes("nonce")
+	cd := negotiateCodec(c.cfg.codecs, peer.Codecs)
+	c.mux.Lock()
+	c.codec = cd
+	c.peer = peer
+	if peer.Auth {
+		c.peerNonce = nonce
+	}
+	c.mux.Unlock()
+}
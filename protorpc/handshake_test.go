@@ -0,0 +1,53 @@
+package protorpc
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestHandshakeCapabilities(t *testing.T) {
+	s := NewServer(nil)
+	s.SetCompression("gzip")
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	p := c.channel.PeerCapabilities()
+	if p.Version != ProtocolVersion || len(p.Codecs) != 1 || p.MaxFrame != MaxFrameSize || p.MaxMessage != MaxMessageSize {
+		t.Fatal(p)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if p := s.Channels()[0].PeerCapabilities(); p.Version != ProtocolVersion || len(p.Codecs) != 0 {
+		t.Fatal(p)
+	}
+}
+
+// 对端声明的MaxFrame小于分片阈值时按MaxFrame分片
+func TestPeerMaxFrame(t *testing.T) {
+	MaxFrameSize = 32 << 10
+	defer func() { MaxFrameSize = 0xffffff }()
+	s := NewServer(nil)
+	s.HandleFunc("echo", func(c *Channel, r *Request) *Response {
+		v, _ := r.GetBytes("v")
+		rsp := NewResponse(r.ReqId(), Result_OK)
+		rsp.SetBytes("v", v)
+		return rsp
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	if n := c.channel.PeerCapabilities().MaxFrame; n != 32<<10 {
+		t.Fatal(n)
+	}
+	big := make([]byte, 200<<10)
+	rand.Read(big)
+	r := NewRequest("echo")
+	r.SetBytes("v", big)
+	rsp := c.Execute(r, 5000)
+	if v, _ := rsp.GetBytes("v"); !bytes.Equal(v, big) {
+		t.Fatal("mismatch", rsp.Result())
+	}
+}
@@ -0,0 +1,90 @@
+package protorpc
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// 按req_id缓存最近的响应,客户端重试时不重复执行handler
+type idemCache struct {
+	window     time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List //按加入顺序,用于过期及超量淘汰
+	mux        sync.Mutex
+}
+
+type idemEntry struct {
+	key    string
+	added  time.Time
+	done   chan struct{} //执行结束后关闭
+	rsp    *Response
+	cached bool //handler未返回(panic)时不缓存结果,等待者需重新执行
+}
+
+func newIdemCache(window time.Duration, maxEntries int) *idemCache {
+	return &idemCache{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// 相同key正在执行时等待其结果,已有结果时直接返回,否则执行fn;
+// 执行期间请求被取消(超时后客户端重试)时仍缓存fn的结果,供重试使用
+func (ic *idemCache) do(ctx context.Context, key string, fn func() *Response) *Response {
+	for {
+		ic.mux.Lock()
+		ic.evict(time.Now())
+		if el, ok := ic.entries[key]; ok {
+			e := el.Value.(*idemEntry)
+			ic.mux.Unlock()
+			select {
+			case <-e.done:
+				if e.cached {
+					return e.rsp
+				}
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		e := &idemEntry{key: key, added: time.Now(), done: make(chan struct{})}
+		ic.entries[key] = ic.order.PushBack(e)
+		ic.mux.Unlock()
+		return ic.run(e, fn)
+	}
+}
+
+func (ic *idemCache) run(e *idemEntry, fn func() *Response) (rsp *Response) {
+	finished := false
+	defer func() {
+		ic.mux.Lock()
+		if finished {
+			e.rsp, e.cached = rsp, true
+		} else if el, ok := ic.entries[e.key]; ok && el.Value == e {
+			ic.order.Remove(el)
+			delete(ic.entries, e.key)
+		}
+		ic.mux.Unlock()
+		close(e.done)
+	}()
+	rsp = fn()
+	finished = true
+	return
+}
+
+// 移除过期的及超出数量的记录,正在执行的记录被移除后重复请求将不再等待
+func (ic *idemCache) evict(now time.Time) {
+	for el := ic.order.Front(); el != nil; el = ic.order.Front() {
+		e := el.Value.(*idemEntry)
+		if (ic.maxEntries <= 0 || ic.order.Len() <= ic.maxEntries) && now.Sub(e.added) < ic.window {
+			return
+		}
+		ic.order.Remove(el)
+		delete(ic.entries, e.key)
+	}
+}
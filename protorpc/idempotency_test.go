@@ -0,0 +1,163 @@
+package protorpc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func counterServer(n *int32) *Server {
+	s := NewServer(nil)
+	s.HandleFunc("inc", func(c *Channel, r *Request) *Response {
+		rsp := NewResponse(r.ReqId(), Result_OK)
+		rsp.SetInt32("v", atomic.AddInt32(n, 1))
+		return rsp
+	})
+	return s
+}
+
+func incr(t *testing.T, c *Client, id string) int32 {
+	rsp := c.Execute(NewRequest2(id, "inc"), 1000)
+	v, err := rsp.GetInt32("v")
+	if err != nil {
+		t.Fatal(rsp)
+	}
+	return v
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	var n int32
+	s := counterServer(&n)
+	s.SetIdempotency(200*time.Millisecond, 2)
+	addr := serve(t, s)
+	defer s.Stop()
+	c1, c2 := connect(t, addr), connect(t, addr)
+	defer c1.Close()
+	defer c2.Close()
+
+	if v := incr(t, c1, "id-1"); v != 1 {
+		t.Fatal(v)
+	}
+	if v := incr(t, c1, "id-1"); v != 1 {
+		t.Fatal("not cached:", v)
+	}
+	// 其他客户端相同的req_id不共用结果
+	if v := incr(t, c2, "id-1"); v != 2 {
+		t.Fatal("shared across clients:", v)
+	}
+	// 超出数量后最早的记录被淘汰
+	incr(t, c1, "id-2")
+	incr(t, c1, "id-3")
+	if v := incr(t, c1, "id-1"); v != 5 {
+		t.Fatal("not evicted:", v)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if v := incr(t, c1, "id-1"); v != 6 {
+		t.Fatal("not expired:", v)
+	}
+}
+
+func TestIdempotencyDisabled(t *testing.T) {
+	var n int32
+	s := counterServer(&n)
+	s.SetIdempotency(time.Minute, 10)
+	s.SetIdempotency(0, 10)
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	incr(t, c, "id-1")
+	if v := incr(t, c, "id-1"); v != 2 {
+		t.Fatal(v)
+	}
+}
+
+// 正在执行时相同key等待结果,执行期间被取消仍缓存结果
+func TestIdemCacheWait(t *testing.T) {
+	ic := newIdemCache(time.Minute, 0)
+	var n int32
+	release := make(chan struct{})
+	fn := func() *Response {
+		<-release
+		rsp := NewResponse("r", Result_OK)
+		rsp.SetInt32("v", atomic.AddInt32(&n, 1))
+		return rsp
+	}
+	got := make(chan *Response, 2)
+	for i := 0; i < 2; i++ {
+		go func() { got <- ic.do(context.Background(), "k", fn) }()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	a, b := <-got, <-got
+	if a != b || atomic.LoadInt32(&n) != 1 {
+		t.Fatal(a, b)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	first := ic.do(ctx, "c", fn)
+	if rsp := ic.do(context.Background(), "c", fn); rsp != first || atomic.LoadInt32(&n) != 2 {
+		t.Fatal("cancelled result not cached")
+	}
+}
+
+// 超时后客户端重试,等待首次执行的结果而不重复执行
+func TestIdempotentRetryAfterTimeout(t *testing.T) {
+	var n int32
+	s := NewServer(nil)
+	s.SetIdempotency(time.Minute, 0)
+	s.HandleFunc("slow", func(c *Channel, r *Request) *Response {
+		time.Sleep(300 * time.Millisecond)
+		rsp := NewResponse(r.ReqId(), Result_OK)
+		rsp.SetInt32("v", atomic.AddInt32(&n, 1))
+		return rsp
+	})
+	c := connect(t, serve(t, s), func(c *Client) {
+		c.SetRetryPolicy("", RetryPolicy{MaxAttempts: 3, PerTryTimeout: 200 * time.Millisecond, Backoff: Backoff{Base: 10 * time.Millisecond}})
+	})
+	defer s.Stop()
+	defer c.Close()
+
+	rsp := c.Execute(NewRequest("slow"), 2000)
+	if v, _ := rsp.GetInt32("v"); !rsp.IsOK() || v != 1 {
+		t.Fatal(rsp)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if v := atomic.LoadInt32(&n); v != 1 {
+		t.Fatal("handler ran", v, "times")
+	}
+}
+
+// 重连后重试相同req_id的请求仍命中缓存
+func TestIdempotentRetryAfterReconnect(t *testing.T) {
+	var n int32
+	s := NewServer(nil)
+	s.SetIdempotency(time.Minute, 0)
+	s.HandleFunc("inc", func(c *Channel, r *Request) *Response {
+		v := atomic.AddInt32(&n, 1)
+		rsp := NewResponse(r.ReqId(), Result_OK)
+		rsp.SetInt32("v", v)
+		if v == 1 {
+			c.Close()
+		}
+		return rsp
+	})
+	addr := serve(t, s)
+	defer s.Stop()
+	c := NewClient(addr, 20, nil, nil)
+	c.SetRetryPolicy("", RetryPolicy{MaxAttempts: 5, Backoff: Backoff{Base: 50 * time.Millisecond}})
+	if !c.Serve() {
+		t.Fatal("serve failed")
+	}
+	defer c.Close()
+
+	rsp := c.Execute(NewRequest("inc"), 2000)
+	if v, _ := rsp.GetInt32("v"); !rsp.IsOK() || v != 1 {
+		t.Fatal(rsp)
+	}
+	if v := atomic.LoadInt32(&n); v != 1 {
+		t.Fatal("handler ran", v, "times")
+	}
+}
@@ -0,0 +1,57 @@
+package protorpc
+
+import (
+	"context"
+	"errors"
+)
+
+// 服务端拦截器,包装Handler的调用;不调用next直接返回即可短路处理
+type Interceptor func(c *Channel, r *Request, next Handler) *Response
+
+// 发送请求的实际调用,Notice成功时返回nil
+type Invoker func(ctx context.Context, c *Channel, r *Request) *Response
+
+// 客户端拦截器,包装Channel.Execute/Notice;不调用invoke直接返回即可短路处理
+type CallInterceptor func(ctx context.Context, c *Channel, r *Request, invoke Invoker) *Response
+
+type noticeKey struct{}
+
+// 拦截器中判断当前调用是否为Notice
+func IsNotice(ctx context.Context) bool {
+	v, _ := ctx.Value(noticeKey{}).(bool)
+	return v
+}
+
+// 先注册的拦截器在外层
+func chainHandler(its []Interceptor, h Handler) Handler {
+	for i := len(its) - 1; i >= 0; i-- {
+		it, next := its[i], h
+		h = HandlerFunc(func(c *Channel, r *Request) *Response {
+			return it(c, r, next)
+		})
+	}
+	return h
+}
+
+func chainInvoker(its []CallInterceptor, invoke Invoker) Invoker {
+	for i := len(its) - 1; i >= 0; i-- {
+		it, next := its[i], invoke
+		invoke = func(ctx context.Context, c *Channel, r *Request) *Response {
+			return it(ctx, c, r, next)
+		}
+	}
+	return invoke
+}
+
+func responseError(rsp *Response) error {
+	if rsp == nil || rsp.IsOK() {
+		return nil
+	}
+	if rsp.Result() == Result_LINK_BROKEN {
+		return ErrLinkBroken
+	}
+	if rsp.Result() == Result_QUEUE_FULL {
+		return ErrQueueFull
+	}
+	return errors.New(rsp.String())
+}
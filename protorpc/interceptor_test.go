@@ -0,0 +1,82 @@
+package protorpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerInterceptorOrder(t *testing.T) {
+	s := NewServer(nil)
+	var mu sync.Mutex
+	var order []string
+	trace := func(name string) Interceptor {
+		return func(c *Channel, r *Request, next Handler) *Response {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			if name == "a" && r.Cmd() == "deny" {
+				return NewResponse2(r.ReqId(), Result_INVALID_REQUEST, "denied")
+			}
+			return next.Handle(c, r)
+		}
+	}
+	s.Intercept(trace("a"), trace("b"))
+	s.HandleFunc("ok", func(c *Channel, r *Request) *Response { return NewResponse(r.ReqId(), Result_OK) })
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	if r := c.Execute(NewRequest("ok"), 1000); !r.IsOK() {
+		t.Fatal(r)
+	}
+	if r := c.Execute(NewRequest("deny"), 1000); r.Result() != Result_INVALID_REQUEST {
+		t.Fatal(r)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 3 || order[0] != "a" || order[1] != "b" || order[2] != "a" {
+		t.Fatal(order)
+	}
+}
+
+func TestCallInterceptor(t *testing.T) {
+	s := NewServer(nil)
+	got := make(chan string, 1)
+	s.HandleFunc("ok", func(c *Channel, r *Request) *Response {
+		v, _ := r.GetString("tag")
+		got <- v
+		return nil
+	})
+	var notices int
+	c := connect(t, serve(t, s), func(c *Client) {
+		c.InterceptCall(func(ctx context.Context, ch *Channel, r *Request, invoke Invoker) *Response {
+			if IsNotice(ctx) {
+				notices++
+			}
+			if r.Cmd() == "local" {
+				return NewResponse(r.ReqId(), Result_OK)
+			}
+			r.SetString("tag", "intercepted")
+			return invoke(ctx, ch, r)
+		})
+	})
+	defer s.Stop()
+	defer c.Close()
+
+	if r := c.Execute(NewRequest("local"), 1000); !r.IsOK() {
+		t.Fatal(r)
+	}
+	if err := c.Notice(NewRequest("ok")); err != nil || notices != 1 {
+		t.Fatal(err, notices)
+	}
+	select {
+	case v := <-got:
+		if v != "intercepted" {
+			t.Fatal(v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notice not delivered")
+	}
+}
@@ -12,6 +12,8 @@ It has these top-level messages:
 	Entity
 	Request
 	Response
+	Window
+	StreamFrame
 	Message
 */
 package internal
@@ -91,6 +93,8 @@ type Request struct {
 	ReqId            *string   `protobuf:"bytes,1,req,name=req_id" json:"req_id,omitempty"`
 	Cmd              *string   `protobuf:"bytes,2,req,name=cmd" json:"cmd,omitempty"`
 	Entity           []*Entity `protobuf:"bytes,3,rep,name=entity" json:"entity,omitempty"`
+	Timeout          *int64    `protobuf:"varint,4,opt,name=timeout" json:"timeout,omitempty"`
+	Window           *int32    `protobuf:"varint,5,opt,name=window" json:"window,omitempty"`
 	XXX_unrecognized []byte    `json:"-"`
 }
 
@@ -119,11 +123,26 @@ func (m *Request) GetEntity() []*Entity {
 	return nil
 }
 
+func (m *Request) GetTimeout() int64 {
+	if m != nil && m.Timeout != nil {
+		return *m.Timeout
+	}
+	return 0
+}
+
+func (m *Request) GetWindow() int32 {
+	if m != nil && m.Window != nil {
+		return *m.Window
+	}
+	return 0
+}
+
 type Response struct {
 	ReqId            *string   `protobuf:"bytes,1,req,name=req_id" json:"req_id,omitempty"`
 	Result           *int32    `protobuf:"varint,2,req,name=result" json:"result,omitempty"`
 	Errmsg           *string   `protobuf:"bytes,4,opt,name=errmsg" json:"errmsg,omitempty"`
 	Entity           []*Entity `protobuf:"bytes,3,rep,name=entity" json:"entity,omitempty"`
+	More             *bool     `protobuf:"varint,5,opt,name=more" json:"more,omitempty"`
 	XXX_unrecognized []byte    `json:"-"`
 }
 
@@ -159,12 +178,103 @@ func (m *Response) GetEntity() []*Entity {
 	return nil
 }
 
-type Message struct {
-	Request          *Request  `protobuf:"bytes,1,opt,name=request" json:"request,omitempty"`
-	Response         *Response `protobuf:"bytes,2,opt,name=response" json:"response,omitempty"`
+func (m *Response) GetMore() bool {
+	if m != nil && m.More != nil {
+		return *m.More
+	}
+	return false
+}
+
+type Window struct {
+	ReqId            *string `protobuf:"bytes,1,req,name=req_id" json:"req_id,omitempty"`
+	Credit           *int32  `protobuf:"varint,2,req,name=credit" json:"credit,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Window) Reset()         { *m = Window{} }
+func (m *Window) String() string { return proto.CompactTextString(m) }
+func (*Window) ProtoMessage()    {}
+
+func (m *Window) GetReqId() string {
+	if m != nil && m.ReqId != nil {
+		return *m.ReqId
+	}
+	return ""
+}
+
+func (m *Window) GetCredit() int32 {
+	if m != nil && m.Credit != nil {
+		return *m.Credit
+	}
+	return 0
+}
+
+type StreamFrame struct {
+	StreamId         *string   `protobuf:"bytes,1,req,name=stream_id" json:"stream_id,omitempty"`
+	Cmd              *string   `protobuf:"bytes,2,opt,name=cmd" json:"cmd,omitempty"`
+	Entity           []*Entity `protobuf:"bytes,3,rep,name=entity" json:"entity,omitempty"`
+	Flags            *int32    `protobuf:"varint,4,opt,name=flags" json:"flags,omitempty"`
+	Credit           *int32    `protobuf:"varint,5,opt,name=credit" json:"credit,omitempty"`
+	Errmsg           *string   `protobuf:"bytes,6,opt,name=errmsg" json:"errmsg,omitempty"`
 	XXX_unrecognized []byte    `json:"-"`
 }
 
+func (m *StreamFrame) Reset()         { *m = StreamFrame{} }
+func (m *StreamFrame) String() string { return proto.CompactTextString(m) }
+func (*StreamFrame) ProtoMessage()    {}
+
+func (m *StreamFrame) GetStreamId() string {
+	if m != nil && m.StreamId != nil {
+		return *m.StreamId
+	}
+	return ""
+}
+
+func (m *StreamFrame) GetCmd() string {
+	if m != nil && m.Cmd != nil {
+		return *m.Cmd
+	}
+	return ""
+}
+
+func (m *StreamFrame) GetEntity() []*Entity {
+	if m != nil {
+		return m.Entity
+	}
+	return nil
+}
+
+func (m *StreamFrame) GetFlags() int32 {
+	if m != nil && m.Flags != nil {
+		return *m.Flags
+	}
+	return 0
+}
+
+func (m *StreamFrame) GetCredit() int32 {
+	if m != nil && m.Credit != nil {
+		return *m.Credit
+	}
+	return 0
+}
+
+func (m *StreamFrame) GetErrmsg() string {
+	if m != nil && m.Errmsg != nil {
+		return *m.Errmsg
+	}
+	return ""
+}
+
+type Message struct {
+	Request          *Request     `protobuf:"bytes,1,opt,name=request" json:"request,omitempty"`
+	Response         *Response    `protobuf:"bytes,2,opt,name=response" json:"response,omitempty"`
+	Cancel           *string      `protobuf:"bytes,3,opt,name=cancel" json:"cancel,omitempty"`
+	Goaway           *bool        `protobuf:"varint,4,opt,name=goaway" json:"goaway,omitempty"`
+	Window           *Window      `protobuf:"bytes,5,opt,name=window" json:"window,omitempty"`
+	Stream           *StreamFrame `protobuf:"bytes,6,opt,name=stream" json:"stream,omitempty"`
+	XXX_unrecognized []byte       `json:"-"`
+}
+
 func (m *Message) Reset()         { *m = Message{} }
 func (m *Message) String() string { return proto.CompactTextString(m) }
 func (*Message) ProtoMessage()    {}
@@ -183,5 +293,33 @@ func (m *Message) GetResponse() *Response {
 	return nil
 }
 
+func (m *Message) GetCancel() string {
+	if m != nil && m.Cancel != nil {
+		return *m.Cancel
+	}
+	return ""
+}
+
+func (m *Message) GetGoaway() bool {
+	if m != nil && m.Goaway != nil {
+		return *m.Goaway
+	}
+	return false
+}
+
+func (m *Message) GetWindow() *Window {
+	if m != nil {
+		return m.Window
+	}
+	return nil
+}
+
+func (m *Message) GetStream() *StreamFrame {
+	if m != nil {
+		return m.Stream
+	}
+	return nil
+}
+
 func init() {
 }
@@ -0,0 +1,75 @@
+package protorpc
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeUnixListener(t *testing.T) {
+	s := NewServer(nil)
+	s.HandleFunc("ping", func(c *Channel, r *Request) *Response { return NewResponse(r.ReqId(), Result_OK) })
+	sock := filepath.Join(t.TempDir(), "s.sock")
+	ls, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ls)
+	defer s.Stop()
+
+	c := connect(t, sock, func(c *Client) {
+		c.SetDialer(func(addr string) (net.Conn, error) { return net.Dial("unix", addr) })
+	})
+	defer c.Close()
+	if r := c.Execute(NewRequest("ping"), 1000); !r.IsOK() {
+		t.Fatal(r)
+	}
+}
+
+// 经net.Pipe连接的通道,控制消息积压时阻塞而不断开连接
+func TestServeConnPipe(t *testing.T) {
+	s := NewServer(nil)
+	s.HandleFunc("ping", func(c *Channel, r *Request) *Response { return NewResponse(r.ReqId(), Result_OK) })
+	c := connect(t, "pipe", func(c *Client) {
+		c.SetDialer(func(addr string) (net.Conn, error) {
+			a, b := net.Pipe()
+			s.ServeConn(a)
+			return b, nil
+		})
+	})
+	defer c.Close()
+	if r := c.Execute(NewRequest("ping"), 1000); !r.IsOK() {
+		t.Fatal(r)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	ch := s.Channels()[0]
+	release := make(chan struct{})
+	ch.later(func() { <-release })
+	for i := 0; i < ControlQueueSize; i++ {
+		ch.later(func() {})
+	}
+	done := make(chan struct{})
+	go func() {
+		ch.later(func() {})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("later not blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := ch.Err(); err != nil || !ch.IsValid() {
+		t.Fatal("channel closed:", err)
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("later still blocked")
+	}
+	if r := c.Execute(NewRequest("ping"), 1000); !r.IsOK() {
+		t.Fatal(r)
+	}
+}
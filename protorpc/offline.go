@@ -0,0 +1,226 @@
+package protorpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 离线队列满时的丢弃策略
+const (
+	DropNewest = iota //丢弃新消息,调用方得到ErrQueueFull或Result_QUEUE_FULL
+	DropOldest        //丢弃最早的消息
+)
+
+var ErrQueueFull = errors.New("offline queue full")
+
+// SetOfflineQueue时Size未设置(<=0)所使用的值
+var DefaultOfflineQueueSize = 1024
+
+// 断线重连期间缓存Notice及幂等的Execute,OnConnected后按顺序发送
+type OfflineQueue struct {
+	Size       int                 //最大缓存数量,<=0时使用DefaultOfflineQueueSize
+	TTL        time.Duration       //缓存超过TTL的消息不再发送,0不过期
+	Policy     int                 //DropNewest,DropOldest
+	Idempotent func(*Request) bool //返回true的Execute也缓存,为nil时Execute不缓存
+}
+
+// 启用离线队列,需在Serve前调用
+func (c *Client) SetOfflineQueue(q OfflineQueue) {
+	if q.Size <= 0 {
+		q.Size = DefaultOfflineQueueSize
+	}
+	c.outbox = &outbox{cfg: q, client: c}
+}
+
+type outbox struct {
+	cfg      OfflineQueue
+	client   *Client
+	items    []*outItem
+	flushing bool
+	mux      sync.Mutex
+}
+
+type outItem struct {
+	req    *Request
+	ctx    context.Context
+	expire time.Time
+	state  int32          //0排队中,1已取出,2已取消
+	result chan outResult //Execute等待发送结果,Notice为nil
+}
+
+type outResult struct {
+	ch  chan *Response
+	rsp *Response
+}
+
+// Client仍在重连,未关闭也未放弃
+func (o *outbox) reconnecting() bool {
+	c := o.client
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.state != StateClosed && c.giveUp == nil
+}
+
+// 链路不可用,或仍有缓存未发出时(保持顺序)进入队列
+func (o *outbox) holdNotice(c *Channel) bool {
+	o.mux.Lock()
+	pending := len(o.items) > 0 || o.flushing
+	o.mux.Unlock()
+	if !pending && c.available() {
+		return false
+	}
+	return o.reconnecting()
+}
+
+func (o *outbox) holdExecute(c *Channel, req *Request) bool {
+	return o.cfg.Idempotent != nil && o.cfg.Idempotent(req) && o.holdNotice(c)
+}
+
+func (o *outbox) push(it *outItem) error {
+	if o.cfg.TTL > 0 {
+		it.expire = time.Now().Add(o.cfg.TTL)
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.purge()
+	if len(o.items) >= o.cfg.Size {
+		if o.cfg.Policy != DropOldest || len(o.items) == 0 {
+			return ErrQueueFull
+		}
+		old := o.items[0]
+		o.items = o.items[1:]
+		if atomic.CompareAndSwapInt32(&old.state, 0, 1) {
+			o.drop(old, "dropped from offline queue")
+		}
+	}
+	o.items = append(o.items, it)
+	return nil
+}
+
+// 移除已取消及过期的消息
+func (o *outbox) purge() {
+	now := time.Now()
+	items := o.items[:0]
+	for _, it := range o.items {
+		if atomic.LoadInt32(&it.state) != 0 {
+			continue
+		}
+		if !it.expire.IsZero() && now.After(it.expire) {
+			if atomic.CompareAndSwapInt32(&it.state, 0, 1) {
+				o.drop(it, "expired in offline queue")
+			}
+			continue
+		}
+		items = append(items, it)
+	}
+	for i := len(items); i < len(o.items); i++ {
+		o.items[i] = nil
+	}
+	o.items = items
+}
+
+// 调用前需已将state置为1
+func (o *outbox) drop(it *outItem, reason string) {
+	if it.result != nil {
+		it.result <- outResult{rsp: NewResponse2(it.req.ReqId(), Result_LINK_BROKEN, reason)}
+	} else {
+		Logger.Warn("notice", reason+":", it.req.Cmd())
+	}
+}
+
+func (o *outbox) execute(ctx context.Context, c *Channel, req *Request) *Response {
+	it := &outItem{req: req, ctx: ctx, result: make(chan outResult, 1)}
+	if err := o.push(it); err != nil {
+		return NewResponse(req.ReqId(), Result_QUEUE_FULL)
+	}
+	var expired <-chan time.Time
+	if !it.expire.IsZero() {
+		t := time.NewTimer(time.Until(it.expire))
+		defer t.Stop()
+		expired = t.C
+	}
+	var r outResult
+	select {
+	case r = <-it.result:
+	case <-ctx.Done():
+		if atomic.CompareAndSwapInt32(&it.state, 0, 2) {
+			return ctxResponse(req.ReqId(), ctx.Err())
+		}
+		r = <-it.result
+	case <-expired:
+		if atomic.CompareAndSwapInt32(&it.state, 0, 2) {
+			return NewResponse2(req.ReqId(), Result_LINK_BROKEN, "expired in offline queue")
+		}
+		r = <-it.result
+	}
+	if r.rsp != nil {
+		return r.rsp
+	}
+	return c.await(ctx, req, r.ch)
+}
+
+// 连接建立后按顺序发送缓存的消息,期间新的Notice继续排在队尾
+func (o *outbox) flush(c *Channel) {
+	o.mux.Lock()
+	if o.flushing {
+		o.mux.Unlock()
+		return
+	}
+	o.flushing = true
+	o.mux.Unlock()
+	for {
+		o.mux.Lock()
+		o.purge()
+		if len(o.items) == 0 || !c.available() {
+			o.flushing = false
+			o.mux.Unlock()
+			return
+		}
+		it := o.items[0]
+		o.items[0] = nil
+		o.items = o.items[1:]
+		o.mux.Unlock()
+		if !atomic.CompareAndSwapInt32(&it.state, 0, 1) {
+			continue
+		}
+		if it.result == nil {
+			if err := c.sendNotice(it.req); err != nil {
+				Logger.Warn("failed flush notice:", it.req.Cmd(), err)
+				if err == ErrLinkBroken {
+					o.requeue(it)
+				}
+			}
+			continue
+		}
+		if !c.available() {
+			o.requeue(it)
+			continue
+		}
+		ch, rsp := c.post(it.ctx, it.req)
+		it.result <- outResult{ch: ch, rsp: rsp}
+	}
+}
+
+// 链路再次断开,放回队首等待下次连接
+func (o *outbox) requeue(it *outItem) {
+	atomic.StoreInt32(&it.state, 0)
+	o.mux.Lock()
+	o.items = append([]*outItem{it}, o.items...)
+	o.mux.Unlock()
+}
+
+// Client关闭或放弃重连时丢弃全部缓存
+func (o *outbox) drain(reason string) {
+	o.mux.Lock()
+	items := o.items
+	o.items = nil
+	o.mux.Unlock()
+	for _, it := range items {
+		if atomic.CompareAndSwapInt32(&it.state, 0, 1) {
+			o.drop(it, reason)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package protorpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 队列非空且Idempotent对所有请求返回true时,握手不能进入队列
+func TestOfflineQueueReconnectWithPending(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	got := make(chan string, 1)
+	s := NewServer(nil)
+	s.HandleFunc("n", func(c *Channel, r *Request) *Response {
+		v, _ := r.GetString("v")
+		got <- v
+		return nil
+	})
+	c := NewClient(addr, 20, nil, nil)
+	c.SetOfflineQueue(OfflineQueue{Size: 8, Idempotent: func(*Request) bool { return true }})
+	c.ServeBG()
+	defer c.Close()
+
+	r := NewRequest("n")
+	r.SetString("v", "queued")
+	if err := c.Notice(r); err != nil {
+		t.Fatal(err)
+	}
+	ls, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ls)
+	defer s.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := c.WaitForReady(ctx); err != nil {
+		t.Fatal(err, c.State())
+	}
+	select {
+	case v := <-got:
+		if v != "queued" {
+			t.Fatal(v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued notice not delivered")
+	}
+}
+
+func TestOfflineQueueDropOldest(t *testing.T) {
+	addr := freeAddr(t)
+	var mu sync.Mutex
+	var got []string
+	s := NewServer(nil)
+	s.SetOrder(OrderChannel)
+	s.HandleFunc("n", func(c *Channel, r *Request) *Response {
+		v, _ := r.GetString("v")
+		mu.Lock()
+		got = append(got, v)
+		mu.Unlock()
+		return nil
+	})
+	s.HandleFunc("x", func(c *Channel, r *Request) *Response { return NewResponse(r.ReqId(), Result_OK) })
+	c := NewClient(addr, 20, nil, nil)
+	c.SetOfflineQueue(OfflineQueue{Size: 3, Policy: DropOldest, Idempotent: func(r *Request) bool { return r.Cmd() == "x" }})
+	c.ServeBG()
+	defer c.Close()
+
+	for _, v := range []string{"a", "b", "c", "d"} {
+		r := NewRequest("n")
+		r.SetString("v", v)
+		if err := c.Notice(r); err != nil {
+			t.Fatal(v, err)
+		}
+	}
+	start := time.Now()
+	if r := c.Execute(NewRequest("y"), 1000); r.Result() != Result_LINK_BROKEN || time.Since(start) > 500*time.Millisecond {
+		t.Fatal("non-idempotent queued:", r)
+	}
+	done := make(chan *Response)
+	go func() { done <- c.Execute(NewRequest("x"), 3000) }()
+	time.Sleep(50 * time.Millisecond)
+	ls, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ls)
+	defer s.Stop()
+	if r := <-done; !r.IsOK() {
+		t.Fatal(r)
+	}
+	waitFor(t, "flush", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if got[0] != "c" || got[1] != "d" {
+		t.Fatal(got)
+	}
+}
+
+func TestOfflineQueueDropNewest(t *testing.T) {
+	c := NewClient(freeAddr(t), 20, nil, nil)
+	c.SetOfflineQueue(OfflineQueue{Size: 2, Idempotent: func(*Request) bool { return true }})
+	c.ServeBG()
+
+	if err := c.Notice(NewRequest("n")); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *Response)
+	go func() { done <- c.Execute(NewRequest("x"), 3000) }()
+	time.Sleep(50 * time.Millisecond)
+	if err := c.Notice(NewRequest("n")); err != ErrQueueFull {
+		t.Fatal(err)
+	}
+	if r := c.Execute(NewRequest("x"), 1000); r.Result() != Result_QUEUE_FULL {
+		t.Fatal(r)
+	}
+	// 关闭时丢弃缓存,等待中的Execute立即返回
+	c.Close()
+	select {
+	case r := <-done:
+		if r.Result() != Result_LINK_BROKEN {
+			t.Fatal(r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued execute not released on close")
+	}
+}
+
+func TestOfflineQueueTTL(t *testing.T) {
+	addr := freeAddr(t)
+	got := make(chan string, 2)
+	s := NewServer(nil)
+	s.HandleFunc("n", func(c *Channel, r *Request) *Response {
+		v, _ := r.GetString("v")
+		got <- v
+		return nil
+	})
+	c := NewClient(addr, 20, nil, nil)
+	c.SetOfflineQueue(OfflineQueue{Size: 4, TTL: 50 * time.Millisecond, Idempotent: func(*Request) bool { return true }})
+	c.ServeBG()
+	defer c.Close()
+
+	r := NewRequest("n")
+	r.SetString("v", "stale")
+	c.Notice(r)
+	if r := c.Execute(NewRequest("x"), 1000); r.Result() != Result_LINK_BROKEN || r.GetErrMsg() != "expired in offline queue" {
+		t.Fatal(r)
+	}
+	r = NewRequest("n")
+	r.SetString("v", "fresh")
+	c.Notice(r)
+
+	ls, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ls)
+	defer s.Stop()
+	select {
+	case v := <-got:
+		if v != "fresh" {
+			t.Fatal(v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fresh notice not delivered")
+	}
+	select {
+	case v := <-got:
+		t.Fatal("unexpected", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// 未设置Size时使用默认大小
+func TestOfflineQueueDefaultSize(t *testing.T) {
+	addr := freeAddr(t)
+	c := NewClient(addr, 20, nil, nil)
+	c.SetOfflineQueue(OfflineQueue{})
+	c.ServeBG()
+	defer c.Close()
+	if err := c.Notice(NewRequest("n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 不重连时断开后不再缓存,Notice直接返回错误
+func TestOfflineQueueGiveUpOnDisconnect(t *testing.T) {
+	s := NewServer(nil)
+	addr := serve(t, s)
+	defer s.Stop()
+	c := connect(t, addr, func(c *Client) { c.SetOfflineQueue(OfflineQueue{}) })
+	defer c.Close()
+
+	s.CloseAll()
+	waitFor(t, "disconnect", func() bool { return c.State() != StateReady })
+	if err := c.Notice(NewRequest("n")); err != ErrLinkBroken {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.WaitForReady(ctx); err != ErrGiveUp {
+		t.Fatal(err)
+	}
+}
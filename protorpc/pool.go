@@ -0,0 +1,306 @@
+package protorpc
+
+import (
+	"context"
+	"crypto/tls"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 负载均衡策略
+const (
+	BalanceRoundRobin       = iota //轮询
+	BalanceLeastOutstanding        //未完成请求最少
+	BalanceConsistentHash          //按请求key一致性哈希
+)
+
+var (
+	EjectFailures int32 = 3                //连续失败多少次后摘除
+	EjectDuration       = 10 * time.Second //摘除时长
+	hashReplicas        = 100              //一致性哈希每个节点的虚拟节点数
+)
+
+// 维护到多个服务端的连接,按策略分发请求;每个连接是一个独立重连的Client
+type Pool struct {
+	members    []*poolMember
+	ring       []ringNode
+	strategy   int
+	hashKey    func(*Request) string
+	next       uint32
+	ejectFails int32
+	ejectTime  time.Duration
+	redial     int32
+	tlsConfig  *tls.Config
+	listener   ChannelListener
+	configure  func(*Client)
+	resolver   Resolver
+	stop       context.CancelFunc
+	serving    bool
+	mux        sync.RWMutex
+}
+
+type poolMember struct {
+	c           *Client
+	addr        string
+	outstanding int32
+	fails       int32
+	ejectUntil  int64 //unix nano
+}
+
+type ringNode struct {
+	hash uint32
+	m    *poolMember
+}
+
+// if reDial is zero,no retry
+func NewPool(svrAddrs []string, redialMillis int32, tlsCfg *tls.Config, listener ChannelListener) *Pool {
+	p := &Pool{
+		hashKey:    (*Request).Cmd,
+		ejectFails: EjectFailures,
+		ejectTime:  EjectDuration,
+		redial:     redialMillis,
+		tlsConfig:  tlsCfg,
+		listener:   listener,
+	}
+	for _, addr := range svrAddrs {
+		p.members = append(p.members, &poolMember{addr: addr})
+	}
+	return p
+}
+
+// 地址由resolver提供,地址增减时相应建立或关闭连接
+func NewPoolWithResolver(r Resolver, redialMillis int32, tlsCfg *tls.Config, listener ChannelListener) *Pool {
+	p := NewPool(nil, redialMillis, tlsCfg, listener)
+	p.resolver = r
+	return p
+}
+
+// 设置负载均衡策略,需在Serve前调用
+func (p *Pool) SetStrategy(strategy int) {
+	p.strategy = strategy
+}
+
+// 一致性哈希时从请求中取key,默认为cmd,需在Serve前调用
+func (p *Pool) SetHashKey(fn func(*Request) string) {
+	p.hashKey = fn
+}
+
+// 连续失败failures次后摘除d时长,failures为0不摘除,需在Serve前调用
+func (p *Pool) SetEjection(failures int32, d time.Duration) {
+	p.ejectFails = failures
+	p.ejectTime = d
+}
+
+// 在每个Client Serve前调用,用于注册handler、拦截器、验证等,需在Serve前调用
+func (p *Pool) SetClientConfig(fn func(*Client)) {
+	p.configure = fn
+}
+
+func (p *Pool) Serve() {
+	p.mux.Lock()
+	p.serving = true
+	for _, m := range p.members {
+		p.start(m)
+	}
+	p.rebuildRing()
+	p.mux.Unlock()
+	if p.resolver != nil {
+		var ctx context.Context
+		ctx, p.stop = context.WithCancel(context.Background())
+		watchResolver(ctx, p.resolver, p.setAddrs) //成员随地址加入,不等待
+	}
+}
+
+func (p *Pool) setAddrs(addrs []string) {
+	p.mux.Lock()
+	old := make(map[string]*poolMember, len(p.members))
+	for _, m := range p.members {
+		old[m.addr] = m
+	}
+	list := make([]*poolMember, 0, len(addrs))
+	for _, addr := range addrs {
+		m, ok := old[addr]
+		if !ok {
+			m = &poolMember{addr: addr}
+			if p.serving {
+				p.start(m)
+			}
+		} else if m == nil {
+			continue //重复地址
+		}
+		old[addr] = nil
+		list = append(list, m)
+	}
+	p.members = list
+	p.rebuildRing()
+	p.mux.Unlock()
+	for _, m := range old {
+		if m != nil && m.c != nil {
+			Logger.Info("remove server:", m.addr)
+			m.c.Close()
+		}
+	}
+}
+
+func (p *Pool) start(m *poolMember) {
+	m.c = NewClient(m.addr, p.redial, p.tlsConfig, p.listener)
+	if p.configure != nil {
+		p.configure(m.c)
+	}
+	m.c.ServeBG()
+}
+
+func (p *Pool) rebuildRing() {
+	if p.strategy != BalanceConsistentHash {
+		return
+	}
+	ring := make([]ringNode, 0, len(p.members)*hashReplicas)
+	for _, m := range p.members {
+		for i := 0; i < hashReplicas; i++ {
+			ring = append(ring, ringNode{crc32.ChecksumIEEE([]byte(m.addr + "#" + strconv.Itoa(i))), m})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	p.ring = ring
+}
+
+func (p *Pool) Close() {
+	if p.stop != nil {
+		p.stop()
+	}
+	p.mux.Lock()
+	p.serving = false
+	for _, m := range p.members {
+		if m.c != nil {
+			m.c.Close()
+		}
+	}
+	p.mux.Unlock()
+}
+
+func (p *Pool) Clients() []*Client {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	cs := make([]*Client, 0, len(p.members))
+	for _, m := range p.members {
+		if m.c != nil {
+			cs = append(cs, m.c)
+		}
+	}
+	return cs
+}
+
+// 可用且未被摘除的连接数
+func (p *Pool) ReadyCount() (n int) {
+	now := time.Now().UnixNano()
+	p.mux.RLock()
+	for _, m := range p.members {
+		if m.usable(now, true) {
+			n++
+		}
+	}
+	p.mux.RUnlock()
+	return
+}
+
+func (p *Pool) Execute(req *Request, timeoutMills int) *Response {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMills)*time.Millisecond)
+	defer cancel()
+	return p.ExecuteContext(ctx, req)
+}
+
+func (p *Pool) ExecuteContext(ctx context.Context, req *Request) *Response {
+	m := p.pick(req)
+	if m == nil {
+		return NewResponse(req.ReqId(), Result_LINK_BROKEN)
+	}
+	atomic.AddInt32(&m.outstanding, 1)
+	rsp := m.c.ExecuteContext(ctx, req)
+	atomic.AddInt32(&m.outstanding, -1)
+	p.report(m, rsp.Result())
+	return rsp
+}
+
+func (p *Pool) Notice(req *Request) error {
+	m := p.pick(req)
+	if m == nil {
+		return ErrLinkBroken
+	}
+	err := m.c.Notice(req)
+	if err == ErrLinkBroken {
+		p.report(m, Result_LINK_BROKEN)
+	}
+	return err
+}
+
+func (p *Pool) report(m *poolMember, result int32) {
+	if result != Result_LINK_BROKEN && result != Result_TIMEOUT {
+		atomic.StoreInt32(&m.fails, 0)
+		return
+	}
+	if p.ejectFails > 0 && atomic.AddInt32(&m.fails, 1) >= p.ejectFails {
+		atomic.StoreInt32(&m.fails, 0)
+		atomic.StoreInt64(&m.ejectUntil, time.Now().Add(p.ejectTime).UnixNano())
+		Logger.Warn("eject server:", m.addr)
+	}
+}
+
+func (m *poolMember) usable(now int64, honorEject bool) bool {
+	if m.c == nil || m.c.channel == nil || !m.c.channel.available() {
+		return false
+	}
+	return !honorEject || atomic.LoadInt64(&m.ejectUntil) <= now
+}
+
+func (p *Pool) pick(req *Request) *poolMember {
+	now := time.Now().UnixNano()
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	if m := p.pickUsable(req, now, true); m != nil {
+		return m
+	}
+	// 全部被摘除时忽略摘除状态,避免无可用连接
+	return p.pickUsable(req, now, false)
+}
+
+func (p *Pool) pickUsable(req *Request, now int64, honorEject bool) *poolMember {
+	n := len(p.members)
+	if n == 0 {
+		return nil
+	}
+	switch p.strategy {
+	case BalanceConsistentHash:
+		if len(p.ring) == 0 {
+			return nil
+		}
+		h := crc32.ChecksumIEEE([]byte(p.hashKey(req)))
+		idx := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+		for i := 0; i < len(p.ring); i++ {
+			if m := p.ring[(idx+i)%len(p.ring)].m; m.usable(now, honorEject) {
+				return m
+			}
+		}
+	case BalanceLeastOutstanding:
+		var best *poolMember
+		start := atomic.AddUint32(&p.next, 1)
+		for i := 0; i < n; i++ {
+			m := p.members[(start+uint32(i))%uint32(n)]
+			if m.usable(now, honorEject) && (best == nil || atomic.LoadInt32(&m.outstanding) < atomic.LoadInt32(&best.outstanding)) {
+				best = m
+			}
+		}
+		return best
+	default:
+		start := atomic.AddUint32(&p.next, 1)
+		for i := 0; i < n; i++ {
+			if m := p.members[(start+uint32(i))%uint32(n)]; m.usable(now, honorEject) {
+				return m
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package protorpc
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type hitServers struct {
+	mu    sync.Mutex
+	hits  map[string]int
+	addrs []string
+	srvs  []*Server
+}
+
+func newHitServers(t *testing.T, n int, handle func(addr string, r *Request) *Response) *hitServers {
+	h := &hitServers{hits: map[string]int{}}
+	for i := 0; i < n; i++ {
+		s := NewServer(nil)
+		addr := serve(t, s)
+		s.HandleFunc("x", func(c *Channel, r *Request) *Response {
+			h.mu.Lock()
+			h.hits[addr]++
+			h.mu.Unlock()
+			if handle != nil {
+				return handle(addr, r)
+			}
+			return NewResponse(r.ReqId(), Result_OK)
+		})
+		h.addrs = append(h.addrs, addr)
+		h.srvs = append(h.srvs, s)
+	}
+	return h
+}
+
+func (h *hitServers) reset() map[string]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	old := h.hits
+	h.hits = map[string]int{}
+	return old
+}
+
+func (h *hitServers) stop() {
+	for _, s := range h.srvs {
+		s.Stop()
+		s.CloseAll()
+	}
+}
+
+func servePool(t *testing.T, addrs []string, configs ...func(*Pool)) *Pool {
+	p := NewPool(addrs, 50, nil, nil)
+	for _, fn := range configs {
+		fn(p)
+	}
+	p.Serve()
+	waitFor(t, "pool ready", func() bool { return p.ReadyCount() == len(addrs) })
+	return p
+}
+
+func TestPoolStrategies(t *testing.T) {
+	h := newHitServers(t, 3, nil)
+	defer h.stop()
+
+	key := func(r *Request) string {
+		k, _ := r.GetString("k")
+		return k
+	}
+	for _, st := range []int{BalanceRoundRobin, BalanceConsistentHash} {
+		p := servePool(t, h.addrs, func(p *Pool) {
+			p.SetStrategy(st)
+			p.SetHashKey(key)
+		})
+		h.reset()
+		for i := 0; i < 30; i++ {
+			r := NewRequest("x")
+			r.SetString("k", "same")
+			if rsp := p.Execute(r, 1000); !rsp.IsOK() {
+				t.Fatal(rsp)
+			}
+		}
+		hits := h.reset()
+		if st == BalanceRoundRobin && (len(hits) != 3 || hits[h.addrs[0]] != 10) {
+			t.Fatal("round robin", hits)
+		}
+		if st == BalanceConsistentHash && len(hits) != 1 {
+			t.Fatal("consistent hash", hits)
+		}
+		p.Close()
+	}
+}
+
+func TestPoolLeastOutstanding(t *testing.T) {
+	release := make(chan struct{})
+	held := make(chan string, 1)
+	h := newHitServers(t, 2, func(addr string, r *Request) *Response {
+		if v, _ := r.GetString("hold"); v != "" {
+			held <- addr
+			<-release
+		}
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	defer h.stop()
+	p := servePool(t, h.addrs, func(p *Pool) { p.SetStrategy(BalanceLeastOutstanding) })
+	defer p.Close()
+
+	done := make(chan *Response, 1)
+	go func() {
+		r := NewRequest("x")
+		r.SetString("hold", "yes")
+		done <- p.Execute(r, 2000)
+	}()
+	busy := <-held
+	h.reset()
+	for i := 0; i < 10; i++ {
+		if rsp := p.Execute(NewRequest("x"), 1000); !rsp.IsOK() {
+			t.Fatal(rsp)
+		}
+	}
+	close(release)
+	if hits := h.reset(); hits[busy] != 0 || len(hits) != 1 {
+		t.Fatal(busy, hits)
+	}
+	if rsp := <-done; !rsp.IsOK() {
+		t.Fatal(rsp)
+	}
+}
+
+// 连续超时的节点被摘除,请求转到其余节点
+func TestPoolEjection(t *testing.T) {
+	var slow string
+	h := newHitServers(t, 2, func(addr string, r *Request) *Response {
+		if addr == slow {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	defer h.stop()
+	slow = h.addrs[0]
+	p := servePool(t, h.addrs, func(p *Pool) { p.SetEjection(2, time.Minute) })
+	defer p.Close()
+
+	fails := 0
+	for i := 0; i < 20; i++ {
+		if rsp := p.Execute(NewRequest("x"), 50); rsp.Result() == Result_TIMEOUT {
+			fails++
+		} else if !rsp.IsOK() {
+			t.Fatal(rsp)
+		}
+	}
+	if fails != 2 {
+		t.Fatal("timeouts:", fails)
+	}
+}
+
+func TestPoolMemberDown(t *testing.T) {
+	h := newHitServers(t, 3, nil)
+	defer h.stop()
+	p := servePool(t, h.addrs)
+	defer p.Close()
+
+	h.srvs[0].Stop()
+	h.srvs[0].CloseAll()
+	waitFor(t, "member down", func() bool { return p.ReadyCount() == 2 })
+	for i := 0; i < 10; i++ {
+		if rsp := p.Execute(NewRequest("x"), 1000); !rsp.IsOK() {
+			t.Fatal(rsp)
+		}
+	}
+	if err := p.Notice(NewRequest("x")); err != nil {
+		t.Fatal(err)
+	}
+}
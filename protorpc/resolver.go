@@ -0,0 +1,174 @@
+package protorpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client首次拨号前等待resolver返回地址的最长时间
+var ResolveTimeout = 5 * time.Second
+
+// 地址解析,Watch持续运行至ctx结束,地址集合变化时调用update(首次解析也调用)
+type Resolver interface {
+	Watch(ctx context.Context, update func(addrs []string)) error
+}
+
+type ResolverFunc func(ctx context.Context, update func(addrs []string)) error
+
+func (f ResolverFunc) Watch(ctx context.Context, update func(addrs []string)) error {
+	return f(ctx, update)
+}
+
+// 固定地址列表
+func StaticResolver(addrs ...string) Resolver {
+	return ResolverFunc(func(ctx context.Context, update func([]string)) error {
+		update(addrs)
+		<-ctx.Done()
+		return nil
+	})
+}
+
+// 每隔interval调用load获取地址,有变化时通知;load出错时保留原地址
+func NewPollResolver(interval time.Duration, load func() ([]string, error)) Resolver {
+	return ResolverFunc(func(ctx context.Context, update func([]string)) error {
+		var last []string
+		first := true
+		for {
+			addrs, err := load()
+			if err != nil {
+				Logger.Warn("resolve failed:", err)
+			} else if first || !sameAddrs(last, addrs) {
+				first = false
+				last = addrs
+				update(addrs)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(interval):
+			}
+		}
+	})
+}
+
+// 从文件读取地址,每行一个,忽略空行及#开头的注释;文件修改后重新加载,修改时应写入临时文件后rename替换
+func NewFileResolver(path string, interval time.Duration) Resolver {
+	return &fileResolver{path: path, interval: interval}
+}
+
+type fileResolver struct {
+	path     string
+	interval time.Duration
+}
+
+// 每次Watch使用独立的加载状态,同一resolver可被多个Client或Pool共用
+func (r *fileResolver) Watch(ctx context.Context, update func([]string)) error {
+	l := &fileLoader{path: r.path}
+	return NewPollResolver(r.interval, l.load).Watch(ctx, update)
+}
+
+type fileLoader struct {
+	path  string
+	mtime time.Time
+	last  []string
+}
+
+func (l *fileLoader) load() ([]string, error) {
+	st, err := os.Stat(l.path)
+	if err != nil {
+		return nil, err
+	}
+	if st.ModTime().Equal(l.mtime) {
+		return l.last, nil
+	}
+	bs, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	sc := bufio.NewScanner(bytes.NewReader(bs))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	l.mtime, l.last = st.ModTime(), addrs
+	return addrs, nil
+}
+
+var lookupSRV = net.LookupSRV
+
+// 查询DNS SRV记录(_service._proto.name),按priority升序排列,同priority按地址排序以免每次查询顺序不同
+func NewSRVResolver(service, proto, name string, interval time.Duration) Resolver {
+	return NewPollResolver(interval, func() ([]string, error) {
+		_, srvs, err := lookupSRV(service, proto, name)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, len(srvs))
+		for i, s := range srvs {
+			addrs[i] = net.JoinHostPort(strings.TrimSuffix(s.Target, "."), strconv.Itoa(int(s.Port)))
+		}
+		sort.Sort(srvOrder{srvs, addrs})
+		return addrs, nil
+	})
+}
+
+type srvOrder struct {
+	srvs  []*net.SRV
+	addrs []string
+}
+
+func (o srvOrder) Len() int { return len(o.srvs) }
+
+func (o srvOrder) Less(i, j int) bool {
+	if o.srvs[i].Priority != o.srvs[j].Priority {
+		return o.srvs[i].Priority < o.srvs[j].Priority
+	}
+	return o.addrs[i] < o.addrs[j]
+}
+
+func (o srvOrder) Swap(i, j int) {
+	o.srvs[i], o.srvs[j] = o.srvs[j], o.srvs[i]
+	o.addrs[i], o.addrs[j] = o.addrs[j], o.addrs[i]
+}
+
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 后台运行resolver,返回的chan在首次更新或resolver退出时关闭
+func watchResolver(ctx context.Context, r Resolver, update func([]string)) <-chan struct{} {
+	first := make(chan struct{})
+	var once sync.Once
+	go func() {
+		err := r.Watch(ctx, func(addrs []string) {
+			update(addrs)
+			once.Do(func() { close(first) })
+		})
+		if err != nil && ctx.Err() == nil {
+			Logger.Error("resolver stopped:", err)
+		}
+		once.Do(func() { close(first) })
+	}()
+	return first
+}
@@ -0,0 +1,146 @@
+package protorpc
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 写临时文件后rename,避免resolver读到写了一半的文件
+func writeAddrs(t *testing.T, path, content string, age time.Duration) {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mt := time.Now().Add(age)
+	os.Chtimes(tmp, mt, mt)
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileResolverPool(t *testing.T) {
+	h := newHitServers(t, 2, nil)
+	defer h.stop()
+	f := filepath.Join(t.TempDir(), "addrs")
+	writeAddrs(t, f, "# servers\n"+h.addrs[0]+"\n\n", 0)
+	p := NewPoolWithResolver(NewFileResolver(f, 20*time.Millisecond), 50, nil, nil)
+	p.Serve()
+	defer p.Close()
+	waitFor(t, "first address", func() bool { return p.ReadyCount() == 1 })
+
+	writeAddrs(t, f, h.addrs[0]+"\n"+h.addrs[1]+"\n", time.Second)
+	waitFor(t, "address added", func() bool { return p.ReadyCount() == 2 })
+	writeAddrs(t, f, h.addrs[1]+"\n", 2*time.Second)
+	waitFor(t, "address removed", func() bool { return len(p.Clients()) == 1 })
+	waitFor(t, "removed disconnected", func() bool { return h.srvs[0].ChannelCount() == 0 })
+	if r := p.Execute(NewRequest("x"), 1000); !r.IsOK() {
+		t.Fatal(r)
+	}
+}
+
+// 同一FileResolver的多次Watch各自加载,互不影响
+func TestFileResolverShared(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "addrs")
+	writeAddrs(t, f, "a:1\nb:2\n", 0)
+	r := NewFileResolver(f, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan []string, 4)
+	for i := 0; i < 2; i++ {
+		go r.Watch(ctx, func(a []string) { got <- a })
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case a := <-got:
+			if len(a) != 2 || a[0] != "a:1" || a[1] != "b:2" {
+				t.Fatal(a)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("watch", i, "not updated")
+		}
+	}
+}
+
+func TestSRVResolver(t *testing.T) {
+	s := okServer()
+	addr := serve(t, s)
+	defer s.Stop()
+	_, port, _ := net.SplitHostPort(addr)
+	pn, _ := strconv.Atoi(port)
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", []*net.SRV{
+			{Target: "127.0.0.9.", Port: 1, Priority: 2},
+			{Target: "127.0.0.1.", Port: uint16(pn), Priority: 1},
+		}, nil
+	}
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	c := NewClientWithResolver(NewSRVResolver("rpc", "tcp", "x", time.Second), 50, nil, nil)
+	if !c.Serve() {
+		t.Fatal("serve failed")
+	}
+	defer c.Close()
+	if a := c.ActiveAddr(); a != addr {
+		t.Fatal(a)
+	}
+	if h := c.Health(); len(h) != 2 || h[1].Addr != "127.0.0.9:1" {
+		t.Fatal(h)
+	}
+}
+
+func TestStaticResolver(t *testing.T) {
+	ch := make(chan []string, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- StaticResolver("a", "b").Watch(ctx, func(a []string) { ch <- a }) }()
+	if a := <-ch; len(a) != 2 {
+		t.Fatal(a)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 首次解析较慢时ServeBG及Pool.Serve不阻塞,在后台等待地址
+func TestSlowResolverNotBlocking(t *testing.T) {
+	s := okServer()
+	addr := serve(t, s)
+	defer s.Stop()
+	slow := ResolverFunc(func(ctx context.Context, update func([]string)) error {
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-ctx.Done():
+			return nil
+		}
+		update([]string{addr})
+		<-ctx.Done()
+		return nil
+	})
+
+	start := time.Now()
+	c := NewClientWithResolver(slow, 50, nil, nil)
+	c.ServeBG()
+	defer c.Close()
+	p := NewPoolWithResolver(slow, 50, nil, nil)
+	p.Serve()
+	defer p.Close()
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatal("blocked:", d)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.WaitForReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a := c.ActiveAddr(); a != addr {
+		t.Fatal(a)
+	}
+	waitFor(t, "pool member", func() bool { return p.ReadyCount() == 1 })
+}
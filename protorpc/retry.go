@@ -0,0 +1,68 @@
+package protorpc
+
+import (
+	"context"
+	"time"
+)
+
+// 重试策略,重试时沿用原req_id以便服务端去重,仅用于幂等的命令
+type RetryPolicy struct {
+	MaxAttempts   int           //含首次,小于2不重试
+	Results       []int32       //需重试的结果码,为空时为TIMEOUT,LINK_BROKEN,QUEUE_FULL
+	PerTryTimeout time.Duration //每次尝试的超时,0时只受调用方的ctx限制
+	Backoff       Backoff       //两次尝试之间的等待,不使用其中的MaxAttempts
+}
+
+var defaultRetryResults = []int32{Result_TIMEOUT, Result_LINK_BROKEN, Result_QUEUE_FULL}
+
+// 为cmd设置重试策略,cmd为空时作用于未单独设置的命令,需在Serve前调用
+func (c *Client) SetRetryPolicy(cmd string, p RetryPolicy) {
+	if c.retries == nil {
+		c.retries = make(map[string]*RetryPolicy)
+	}
+	c.retries[cmd] = &p
+}
+
+func (c *Client) retryPolicy(cmd string) *RetryPolicy {
+	if p, ok := c.retries[cmd]; ok {
+		return p
+	}
+	return c.retries[""]
+}
+
+func (p *RetryPolicy) retryable(result int32) bool {
+	results := p.Results
+	if len(results) == 0 {
+		results = defaultRetryResults
+	}
+	for _, r := range results {
+		if r == result {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) executeRetry(ctx context.Context, req *Request, p *RetryPolicy) *Response {
+	for attempt := 0; ; attempt++ {
+		tctx, cancel := ctx, context.CancelFunc(nil)
+		if p.PerTryTimeout > 0 {
+			tctx, cancel = context.WithTimeout(ctx, p.PerTryTimeout)
+		}
+		rsp := c.executeBreaker(tctx, req)
+		if cancel != nil {
+			cancel()
+		}
+		if attempt+1 >= p.MaxAttempts || !p.retryable(rsp.Result()) || ctx.Err() != nil {
+			return rsp
+		}
+		Logger.Warn("retry request:", req.Cmd(), req.ReqId(), rsp.String())
+		t := time.NewTimer(p.Backoff.delay(attempt))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return rsp
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package protorpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 按req_id计数,前fails次以result应答
+func flakyServer(fails int, result int32) (*Server, func(id string) int) {
+	var mu sync.Mutex
+	ids := map[string]int{}
+	s := NewServer(nil)
+	s.HandleContextFunc("flaky", func(ctx context.Context, c *Channel, r *Request) *Response {
+		mu.Lock()
+		ids[r.ReqId()]++
+		n := ids[r.ReqId()]
+		mu.Unlock()
+		if n > fails {
+			return NewResponse(r.ReqId(), Result_OK)
+		}
+		if result == Result_TIMEOUT {
+			<-ctx.Done()
+			return nil
+		}
+		return NewResponse(r.ReqId(), result)
+	})
+	return s, func(id string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return ids[id]
+	}
+}
+
+func TestRetrySameReqId(t *testing.T) {
+	s, attempts := flakyServer(2, Result_QUEUE_FULL)
+	c := connect(t, serve(t, s), func(c *Client) {
+		c.SetRetryPolicy("flaky", RetryPolicy{MaxAttempts: 3, Backoff: Backoff{Base: 5 * time.Millisecond}})
+	})
+	defer s.Stop()
+	defer c.Close()
+
+	r := NewRequest("flaky")
+	if rsp := c.Execute(r, 1000); !rsp.IsOK() || attempts(r.ReqId()) != 3 {
+		t.Fatal(rsp, attempts(r.ReqId()))
+	}
+}
+
+func TestRetryPerTryTimeout(t *testing.T) {
+	s, attempts := flakyServer(1, Result_TIMEOUT)
+	c := connect(t, serve(t, s), func(c *Client) {
+		c.SetRetryPolicy("", RetryPolicy{MaxAttempts: 2, PerTryTimeout: 50 * time.Millisecond})
+	})
+	defer s.Stop()
+	defer c.Close()
+
+	r := NewRequest("flaky")
+	if rsp := c.Execute(r, 1000); !rsp.IsOK() || attempts(r.ReqId()) != 2 {
+		t.Fatal(rsp, attempts(r.ReqId()))
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	s, attempts := flakyServer(5, Result_QUEUE_FULL)
+	c := connect(t, serve(t, s), func(c *Client) {
+		c.SetRetryPolicy("flaky", RetryPolicy{MaxAttempts: 2})
+		c.SetRetryPolicy("", RetryPolicy{MaxAttempts: 5, Results: []int32{Result_TIMEOUT}})
+	})
+	defer s.Stop()
+	defer c.Close()
+
+	r := NewRequest("flaky")
+	if rsp := c.Execute(r, 1000); rsp.Result() != Result_QUEUE_FULL || attempts(r.ReqId()) != 2 {
+		t.Fatal(rsp, attempts(r.ReqId()))
+	}
+	// 默认策略只重试TIMEOUT,未注册的命令不重试
+	if rsp := c.Execute(NewRequest("nope"), 1000); rsp.Result() != Result_HANDLER_NOT_FOUND {
+		t.Fatal(rsp)
+	}
+}
+
+func TestRetryResults(t *testing.T) {
+	p := RetryPolicy{}
+	if !p.retryable(Result_LINK_BROKEN) || p.retryable(Result_SERVER_EXCEPTION) {
+		t.Fatal("default results")
+	}
+	p.Results = []int32{Result_SERVER_EXCEPTION}
+	if p.retryable(Result_LINK_BROKEN) || !p.retryable(Result_SERVER_EXCEPTION) {
+		t.Fatal("custom results")
+	}
+}
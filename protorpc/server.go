@@ -1,23 +1,47 @@
 package protorpc
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	listener ChannelListener
+	listener serverListener
 	handlers map[string]Handler
+	cfg      channelConfig
 	ls       net.Listener
 	stop     int32
+
+	mux      sync.Mutex
+	conns    int32         //已接入的通道数
+	draining chan struct{} //Shutdown开始时关闭
+	kill     chan struct{} //Shutdown超时时关闭
+	chls     map[*Channel]struct{}
+	addrMap  map[string]*Channel
+}
+
+type serverListener struct {
+	listener ChannelListener
+	*Server
 }
 
 func NewServer(listener ChannelListener) *Server {
 	s := &Server{
-		listener: listener,
 		handlers: make(map[string]Handler),
+		draining: make(chan struct{}),
+		kill:     make(chan struct{}),
+		chls:     make(map[*Channel]struct{}),
+		addrMap:  make(map[string]*Channel),
 	}
+	s.listener.listener = listener
+	s.listener.Server = s
 	return s
 }
 
@@ -35,26 +59,94 @@ func (s *Server) Handle(cmd string, handler Handler) {
 	s.handlers[cmd] = handler
 }
 
+func (s *Server) HandleContext(cmd string, handler ContextHandler) {
+	s.Handle(cmd, ctxHandler{handler})
+}
+
+func (s *Server) HandleContextFunc(cmd string, handler func(context.Context, *Channel, *Request) *Response) {
+	s.Handle(cmd, ctxHandler{ContextHandlerFunc(handler)})
+}
+
+func (s *Server) HandleServerStream(cmd string, handler ServerStreamHandler) {
+	s.Handle(cmd, streamHandler{handler})
+}
+
+func (s *Server) HandleServerStreamFunc(cmd string, handler func(context.Context, *Channel, *Request, *ResponseWriter) *Response) {
+	s.Handle(cmd, streamHandler{ServerStreamHandlerFunc(handler)})
+}
+
+func (s *Server) HandleStream(cmd string, handler StreamHandler) {
+	s.cfg.handleStream(cmd, handler)
+}
+
+func (s *Server) HandleStreamFunc(cmd string, handler func(*Stream)) {
+	s.cfg.handleStream(cmd, StreamHandlerFunc(handler))
+}
+
+// 注册处理请求的拦截器,按注册顺序由外到内执行,需在Serve前调用
+func (s *Server) Intercept(its ...Interceptor) {
+	s.cfg.interceptors = append(s.cfg.interceptors, its...)
+}
+
+// 注册发送请求的拦截器,按注册顺序由外到内执行,需在Serve前调用
+func (s *Server) InterceptCall(its ...CallInterceptor) {
+	s.cfg.callInterceptors = append(s.cfg.callInterceptors, its...)
+}
+
+// 限制所有通道合计的并发处理数及排队数,需在Serve前调用
+func (s *Server) SetLimit(concurrency, queueSize int) {
+	s.cfg.shared = newWorkers(concurrency, queueSize)
+}
+
+// 限制单个通道的并发处理数及排队数,需在Serve前调用
+func (s *Server) SetChannelLimit(concurrency, queueSize int) {
+	s.cfg.concurrency = concurrency
+	s.cfg.queueSize = queueSize
+}
+
+// 设置请求的处理顺序(OrderNone,OrderChannel,OrderCommand),需在Serve前调用
+func (s *Server) SetOrder(mode int) {
+	s.cfg.order = mode
+}
+
+// 记住window时长内最多maxEntries个(0不限)请求的响应,同一调用方相同req_id的重复请求直接返回缓存的响应,
+// 前一个仍在处理时等待其结果;调用方在有验证时为principal,否则为对端实例(重连后不变);
+// server stream请求不缓存,window<=0时关闭,需在Serve前调用
+func (s *Server) SetIdempotency(window time.Duration, maxEntries int) {
+	if window <= 0 {
+		s.cfg.idem = nil
+		return
+	}
+	s.cfg.idem = newIdemCache(window, maxEntries)
+}
+
+// 启用帧压缩,按优先顺序列出支持的算法(gzip,flate),连接时与对端协商,需在Serve前调用
+func (s *Server) SetCompression(codecs ...string) {
+	for _, name := range codecs {
+		if codecByName(name) == nil {
+			panic("unknown codec:" + name)
+		}
+	}
+	s.cfg.codecs = codecs
+}
+
+// 要求对端在OnConnected之前通过验证,未通过的连接被关闭,需在Serve前调用
+func (s *Server) SetAuthenticator(auth Authenticator) {
+	s.cfg.auth = auth
+}
+
+// 对端要求验证时提供的本端凭证,需在Serve前调用
+func (s *Server) SetCredentials(cred Credentials) {
+	s.cfg.credentials = cred
+}
+
 func (s *Server) Serve(addr string) error {
 	ls, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	s.ls = ls
 	Logger.Info("start serve tcp:", addr)
-	atomic.StoreInt32(&s.stop, 0)
-	for {
-		cc, err := ls.Accept()
-		if err != nil {
-			if atomic.LoadInt32(&s.stop) != 0 {
-				return nil
-			}
-			return err
-		}
-		c := newChannel(s.handlers, s.listener)
-		c.serve(cc)
-	}
-	return nil
+	return s.ServeListener(ls)
 }
 
 func (s *Server) ServeTls(addr string, tlsCfg *tls.Config) error {
@@ -62,8 +154,15 @@ func (s *Server) ServeTls(addr string, tlsCfg *tls.Config) error {
 	if err != nil {
 		return err
 	}
-	s.ls = ls
 	Logger.Info("start serve tls:", addr)
+	return s.ServeListener(ls)
+}
+
+// 在已有的listener上服务,如unix socket,systemd socket activation等
+func (s *Server) ServeListener(ls net.Listener) error {
+	s.mux.Lock()
+	s.ls = ls
+	s.mux.Unlock()
 	atomic.StoreInt32(&s.stop, 0)
 	for {
 		cc, err := ls.Accept()
@@ -73,10 +172,14 @@ func (s *Server) ServeTls(addr string, tlsCfg *tls.Config) error {
 			}
 			return err
 		}
-		c := newChannel(s.handlers, s.listener)
-		c.serve(cc)
+		s.ServeConn(cc)
 	}
-	return nil
+}
+
+// 服务单个已建立的连接,如net.Pipe
+func (s *Server) ServeConn(conn net.Conn) {
+	c := newChannel(s.handlers, &s.cfg, &s.listener)
+	go c.serve(conn)
 }
 
 func (s *Server) ServeTlsWithPem(addr string, pem, key []byte) error {
@@ -101,7 +204,177 @@ func (s *Server) ServeTlsWithPemFile(addr, pem, key string) error {
 	return s.ServeTls(addr, tlsConfig)
 }
 
+// 要求客户端提供由clientCAs签发的证书
+func (s *Server) ServeTlsWithClientCA(addr string, tlsCfg *tls.Config, clientCAs *x509.CertPool) error {
+	cfg := &tls.Config{}
+	if tlsCfg != nil {
+		cfg = tlsCfg.Clone()
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.ClientCAs = clientCAs
+	return s.ServeTls(addr, cfg)
+}
+
+func (s *Server) ServeTlsWithPemFileAndClientCA(addr, pem, key, ca string) error {
+	cert, err := tls.LoadX509KeyPair(pem, key)
+	if err != nil {
+		return err
+	}
+	pool, err := loadCertPool(ca)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	return s.ServeTlsWithClientCA(addr, tlsConfig, pool)
+}
+
+// 证书由reloader提供,更新证书无需重启;tlsCfg可为nil
+func (s *Server) ServeTlsWithReloader(addr string, tlsCfg *tls.Config, reloader *TlsReloader) error {
+	return s.ServeTls(addr, reloader.serverConfig(tlsCfg))
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		return nil, errors.New("no certificate in " + file)
+	}
+	return pool, nil
+}
+
 func (s *Server) Stop() {
 	atomic.StoreInt32(&s.stop, 1)
-	s.ls.Close()
+	s.closeListener()
+}
+
+func (s *Server) closeListener() {
+	s.mux.Lock()
+	ls := s.ls
+	s.mux.Unlock()
+	if ls != nil {
+		ls.Close()
+	}
+}
+
+// 停止接收新连接,通知已连接的对端不再发送新请求,
+// 等待处理中的请求完成并写回响应后关闭所有通道;ctx结束时强制关闭剩余通道
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.stop, 1)
+	s.closeListener()
+	s.closeOnce(s.draining)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&s.conns) != 0 {
+		select {
+		case <-ctx.Done():
+			s.closeOnce(s.kill)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (s *Server) closeOnce(ch chan struct{}) {
+	s.mux.Lock()
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+	s.mux.Unlock()
+}
+
+// Shutdown时通知对端goaway,通道上处理中的请求完成后关闭该通道
+func (s *Server) watch(c *Channel, ctx context.Context) {
+	defer atomic.AddInt32(&s.conns, -1)
+	select {
+	case <-ctx.Done():
+		return
+	case <-s.draining:
+	}
+	if err := c.sendGoaway(); err != nil {
+		Logger.Warn("failed goaway:", c.String(), err)
+	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&c.inflight) != 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.kill:
+			c.Close()
+			return
+		case <-ticker.C:
+		}
+	}
+	c.Close()
+	<-ctx.Done()
+}
+
+// 当前已接入的通道
+func (s *Server) Channels() []*Channel {
+	s.mux.Lock()
+	chls := make([]*Channel, 0, len(s.chls))
+	for c := range s.chls {
+		chls = append(chls, c)
+	}
+	s.mux.Unlock()
+	return chls
+}
+
+func (s *Server) ChannelCount() (n int) {
+	s.mux.Lock()
+	n = len(s.chls)
+	s.mux.Unlock()
+	return
+}
+
+func (s *Server) ChannelByAddr(addr string) (c *Channel, ok bool) {
+	s.mux.Lock()
+	c, ok = s.addrMap[addr]
+	s.mux.Unlock()
+	return
+}
+
+// 关闭所有已接入的通道
+func (s *Server) CloseAll() {
+	for _, c := range s.Channels() {
+		c.Close()
+	}
+}
+
+func (s *serverListener) OnConnecting(c *Channel) {
+	s.mux.Lock()
+	s.chls[c] = struct{}{}
+	s.addrMap[c.RemoteAddr()] = c
+	s.mux.Unlock()
+	atomic.AddInt32(&s.conns, 1)
+	go s.watch(c, c.context())
+	if s.listener != nil {
+		s.listener.OnConnecting(c)
+	}
+}
+
+func (s *serverListener) OnConnected(c *Channel) {
+	if s.listener != nil {
+		s.listener.OnConnected(c)
+	}
+}
+
+func (s *serverListener) OnDisconnect(c *Channel) {
+	s.mux.Lock()
+	delete(s.chls, c)
+	if s.addrMap[c.RemoteAddr()] == c {
+		delete(s.addrMap, c.RemoteAddr())
+	}
+	s.mux.Unlock()
+	if s.listener != nil {
+		s.listener.OnDisconnect(c)
+	}
 }
@@ -0,0 +1,107 @@
+package protorpc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsInflight(t *testing.T) {
+	s := NewServer(nil)
+	s.HandleFunc("slow", func(c *Channel, r *Request) *Response {
+		time.Sleep(300 * time.Millisecond)
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	c := connect(t, serve(t, s))
+	defer c.Close()
+
+	done := make(chan *Response, 1)
+	go func() { done <- c.Execute(NewRequest("slow"), 2000) }()
+	time.Sleep(50 * time.Millisecond)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-done; !r.IsOK() {
+		t.Fatal(r)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if c.IsValid() {
+		t.Fatal("channel still valid after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := NewServer(nil)
+	s.HandleFunc("stuck", func(c *Channel, r *Request) *Response {
+		time.Sleep(time.Second)
+		return nil
+	})
+	c := connect(t, serve(t, s))
+	defer c.Close()
+
+	c.Notice(NewRequest("stuck"))
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if c.IsValid() {
+		t.Fatal("channel not closed on timeout")
+	}
+}
+
+// goaway之后到达的请求以LINK_BROKEN拒绝,不再处理
+func TestRejectAfterGoaway(t *testing.T) {
+	s := NewServer(nil)
+	var handled int32
+	s.HandleFunc("slow", func(c *Channel, r *Request) *Response {
+		atomic.AddInt32(&handled, 1)
+		time.Sleep(300 * time.Millisecond)
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	c := connect(t, serve(t, s))
+	defer c.Close()
+
+	go c.Execute(NewRequest("slow"), 2000)
+	time.Sleep(50 * time.Millisecond)
+	go s.Shutdown(context.Background())
+	time.Sleep(50 * time.Millisecond)
+	if r := c.Execute(NewRequest("slow"), 1000); r.Result() != Result_LINK_BROKEN {
+		t.Fatal(r)
+	}
+	atomic.StoreInt32(&c.channel.goaway, 0) //模拟未及时收到goaway的对端
+	r := c.Execute(NewRequest("slow"), 1000)
+	if r.Result() != Result_LINK_BROKEN || r.GetErrMsg() != "server going away" {
+		t.Fatal(r)
+	}
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Fatal(n)
+	}
+}
+
+func TestChannelRegistry(t *testing.T) {
+	s := NewServer(nil)
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := s.ChannelCount(); n != 1 || len(s.Channels()) != 1 {
+		t.Fatal(n)
+	}
+	addr := c.channel.conn.LocalAddr().String()
+	if ch, ok := s.ChannelByAddr(addr); !ok || ch.RemoteAddr() != addr {
+		t.Fatal(addr)
+	}
+	s.CloseAll()
+	time.Sleep(50 * time.Millisecond)
+	if s.ChannelCount() != 0 || c.IsValid() {
+		t.Fatal("not closed")
+	}
+	if _, ok := s.ChannelByAddr(addr); ok {
+		t.Fatal("closed channel still registered")
+	}
+}
@@ -0,0 +1,224 @@
+package protorpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/ragros/golang/protorpc/internal"
+)
+
+var (
+	StreamWindow int32 = 16 //流式响应的接收窗口,即对端未确认时最多可发送的响应数
+
+	ErrNotStream      = errors.New("NotStream")
+	ErrDuplicateReqId = errors.New("DuplicateReqId")
+)
+
+// 流式处理:通过ResponseWriter发送多个响应,返回的Response作为结束标记
+type ServerStreamHandler interface {
+	HandleServerStream(context.Context, *Channel, *Request, *ResponseWriter) *Response
+}
+
+type ServerStreamHandlerFunc func(context.Context, *Channel, *Request, *ResponseWriter) *Response
+
+func (f ServerStreamHandlerFunc) HandleServerStream(ctx context.Context, c *Channel, r *Request, w *ResponseWriter) *Response {
+	return f(ctx, c, r, w)
+}
+
+type streamHandler struct {
+	ServerStreamHandler
+}
+
+func (h streamHandler) Handle(c *Channel, r *Request) *Response {
+	w := &ResponseWriter{c: c, ctx: r.Context(), reqId: r.ReqId()}
+	if n := r.msg.GetWindow(); n > 0 {
+		w.win = newSendWindow(n)
+		c.putWindow(r.ReqId(), w.win)
+		defer c.remWindow(r.ReqId())
+	}
+	rsp := h.HandleServerStream(r.Context(), c, r, w)
+	if rsp == nil {
+		rsp = NewResponse(r.ReqId(), Result_OK)
+	}
+	rsp.msg.More = nil
+	return rsp
+}
+
+type ResponseWriter struct {
+	c     *Channel
+	ctx   context.Context
+	reqId string
+	win   *sendWindow
+}
+
+// 窗口耗尽时阻塞,直到对端确认或请求被取消
+func (w *ResponseWriter) Send(rsp *Response) error {
+	if w.win == nil {
+		return ErrNotStream
+	}
+	if err := w.win.acquire(w.ctx); err != nil {
+		return err
+	}
+	rsp.msg.ReqId = &w.reqId
+	rsp.msg.More = proto.Bool(true)
+	return w.c.writeResponse(rsp)
+}
+
+type sendWindow struct {
+	mux    sync.Mutex
+	credit int32
+	notify chan struct{}
+}
+
+func newSendWindow(credit int32) *sendWindow {
+	return &sendWindow{
+		credit: credit,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func (w *sendWindow) add(n int32) {
+	w.mux.Lock()
+	w.credit += n
+	w.mux.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *sendWindow) acquire(ctx context.Context) error {
+	for {
+		w.mux.Lock()
+		if w.credit > 0 {
+			w.credit--
+			w.mux.Unlock()
+			return nil
+		}
+		w.mux.Unlock()
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Channel) putWindow(id string, w *sendWindow) {
+	c.mux.Lock()
+	c.windows[id] = w
+	c.mux.Unlock()
+}
+
+func (c *Channel) remWindow(id string) {
+	c.mux.Lock()
+	delete(c.windows, id)
+	c.mux.Unlock()
+}
+
+func (c *Channel) addWindow(id string, n int32) {
+	c.mux.Lock()
+	w, ok := c.windows[id]
+	c.mux.Unlock()
+	if ok {
+		w.add(n)
+	}
+}
+
+func (c *Channel) sendWindowUpdate(id string, n int32) error {
+	bs, err := proto.Marshal(&pb.Message{Window: &pb.Window{ReqId: &id, Credit: &n}})
+	if err != nil {
+		return err
+	}
+	return c.Send(bs)
+}
+
+// 接收流式响应,Recv依次返回各响应,结束后返回io.EOF,此时Result为结束标记
+type ResponseStream struct {
+	c        *Channel
+	ctx      context.Context
+	reqId    string
+	ch       chan *Response
+	window   int32
+	consumed int32
+	final    *Response
+}
+
+func (c *Channel) ExecuteStream(ctx context.Context, req *Request) (*ResponseStream, error) {
+	if !c.available() {
+		return nil, ErrLinkBroken
+	}
+	window := StreamWindow
+	if window < 1 {
+		window = 1
+	}
+	req.msg.Window = &window
+	req.setDeadline(ctx)
+	bs, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := c.putRspChan(req.ReqId(), int(window)+1)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Send(bs); err != nil {
+		c.remRspChan(req.ReqId())
+		return nil, err
+	}
+	s := &ResponseStream{
+		c:      c,
+		ctx:    ctx,
+		reqId:  req.ReqId(),
+		ch:     ch,
+		window: window,
+	}
+	return s, nil
+}
+
+func (s *ResponseStream) Recv() (*Response, error) {
+	if s.final != nil {
+		return nil, io.EOF
+	}
+	select {
+	case m := <-s.ch:
+		if !m.msg.GetMore() {
+			s.final = m
+			s.c.remRspChan(s.reqId)
+			return nil, io.EOF
+		}
+		s.consumed++
+		if s.consumed >= s.window/2 {
+			if err := s.c.sendWindowUpdate(s.reqId, s.consumed); err != nil {
+				Logger.Warn("failed window update:", s.reqId, err)
+			}
+			s.consumed = 0
+		}
+		return m, nil
+	case <-s.ctx.Done():
+		s.Close()
+		s.final = ctxResponse(s.reqId, s.ctx.Err())
+		return nil, s.ctx.Err()
+	}
+}
+
+// 流结束后的结束标记,未结束时为nil
+func (s *ResponseStream) Result() *Response {
+	return s.final
+}
+
+// 提前结束接收,并通知对端取消
+func (s *ResponseStream) Close() {
+	if s.final != nil {
+		return
+	}
+	s.c.remRspChan(s.reqId)
+	if err := s.c.sendCancel(s.reqId); err != nil {
+		Logger.Warn("failed cancel request:", s.reqId, err)
+	}
+	s.final = NewResponse(s.reqId, Result_CLIENT_INTERRUPT)
+}
@@ -0,0 +1,93 @@
+package protorpc
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestServerStream(t *testing.T) {
+	s := NewServer(nil)
+	s.HandleServerStreamFunc("count", func(ctx context.Context, c *Channel, r *Request, w *ResponseWriter) *Response {
+		for i := 0; i < 100; i++ {
+			rsp := NewResponse(r.ReqId(), Result_OK)
+			rsp.SetInt64("i", int64(i))
+			if err := w.Send(rsp); err != nil {
+				return NewResponse2(r.ReqId(), Result_SERVER_EXCEPTION, err.Error())
+			}
+		}
+		rsp := NewResponse(r.ReqId(), Result_OK)
+		rsp.SetString("end", "yes")
+		return rsp
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	st, err := c.ExecuteStream(ctx, NewRequest("count"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		r, err := st.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := r.GetInt64("i"); v != int64(n) {
+			t.Fatal(v, n)
+		}
+		n++
+	}
+	if v, _ := st.Result().GetString("end"); n != 100 || v != "yes" {
+		t.Fatal(n, st.Result())
+	}
+}
+
+// 接收方不读时发送方被窗口阻塞,Close后handler被取消
+func TestServerStreamFlowControl(t *testing.T) {
+	StreamWindow = 4
+	defer func() { StreamWindow = 16 }()
+	s := NewServer(nil)
+	sent := make(chan int, 100)
+	done := make(chan error, 1)
+	s.HandleServerStreamFunc("flood", func(ctx context.Context, c *Channel, r *Request, w *ResponseWriter) *Response {
+		for i := 0; ; i++ {
+			if err := w.Send(NewResponse(r.ReqId(), Result_OK)); err != nil {
+				done <- err
+				return nil
+			}
+			sent <- i
+		}
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	st, err := c.ExecuteStream(context.Background(), NewRequest("flood"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(sent); n != 4 {
+		t.Fatal("sent without credit:", n)
+	}
+	st.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("send should fail after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler not cancelled")
+	}
+	if st.Result().Result() != Result_CLIENT_INTERRUPT {
+		t.Fatal(st.Result())
+	}
+}
@@ -0,0 +1,454 @@
+package protorpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/twinj/uuid"
+
+	pb "github.com/ragros/golang/protorpc/internal"
+)
+
+const (
+	streamOpen  int32 = 1
+	streamData  int32 = 2
+	streamEnd   int32 = 4 //发送方半关闭
+	streamReset int32 = 8 //终止流
+)
+
+var ErrStreamClosed = errors.New("StreamClosed")
+
+// 记录最近结束的流的数量,这些流迟到的帧直接忽略
+var recentStreams = 128
+
+// 双向流的处理,返回时自动半关闭发送方向
+type StreamHandler interface {
+	HandleStream(*Stream)
+}
+
+type StreamHandlerFunc func(*Stream)
+
+func (f StreamHandlerFunc) HandleStream(s *Stream) {
+	f(s)
+}
+
+type StreamMessage struct {
+	dataOper
+	msg *pb.StreamFrame
+}
+
+func NewStreamMessage() *StreamMessage {
+	m := &StreamMessage{msg: &pb.StreamFrame{}}
+	m.dp = m
+	return m
+}
+
+func (t *StreamMessage) entity(key string) *pb.Entity {
+	for _, v := range t.msg.Entity {
+		if v.GetKey() == key {
+			return v
+		}
+	}
+	return nil
+}
+
+func (t *StreamMessage) appendEntity(v *pb.Entity) {
+	t.msg.Entity = append(t.msg.Entity, v)
+}
+
+func (t *StreamMessage) String() string {
+	return proto.CompactTextString(t.msg)
+}
+
+// 双向流,每个方向有独立的流控窗口,慢速的流不会阻塞通道上的其他消息
+type Stream struct {
+	c        *Channel
+	id       string
+	cmd      string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	win      *sendWindow
+	recv     chan *StreamMessage
+	window   int32
+	consumed int32
+
+	mux        sync.Mutex
+	sendClosed bool
+	eof        bool
+	peerEnd    bool //已收到对端的半关闭
+	err        error
+}
+
+func newStream(c *Channel, id, cmd string) *Stream {
+	window := StreamWindow
+	if window < 1 {
+		window = 1
+	}
+	s := &Stream{
+		c:      c,
+		id:     id,
+		cmd:    cmd,
+		win:    newSendWindow(0),
+		recv:   make(chan *StreamMessage, window+1),
+		window: window,
+	}
+	s.ctx, s.cancel = context.WithCancel(c.context())
+	return s
+}
+
+// 打开到对端的双向流,对端以cmd对应的StreamHandler处理
+func (c *Channel) OpenStream(cmd string) (*Stream, error) {
+	if !c.available() {
+		return nil, ErrLinkBroken
+	}
+	s := newStream(c, uuid.Formatter(uuid.NewV4(), uuid.Clean), cmd)
+	if !c.putStream(s) {
+		s.cancel()
+		return nil, ErrLinkBroken
+	}
+	err := c.sendStreamFrame(&pb.StreamFrame{
+		StreamId: &s.id,
+		Cmd:      &cmd,
+		Flags:    proto.Int32(streamOpen),
+		Credit:   &s.window,
+	})
+	if err != nil {
+		s.abort(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Stream) Cmd() string {
+	return s.cmd
+}
+
+func (s *Stream) Channel() *Channel {
+	return s.c
+}
+
+// 流终止或通道断开时被取消
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// 对端窗口耗尽时阻塞
+func (s *Stream) Send(m *StreamMessage) error {
+	s.mux.Lock()
+	closed, err := s.sendClosed, s.err
+	s.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	if closed {
+		return ErrStreamClosed
+	}
+	if err = s.win.acquire(s.ctx); err != nil {
+		return s.Err()
+	}
+	return s.c.sendStreamFrame(&pb.StreamFrame{
+		StreamId: &s.id,
+		Entity:   m.msg.Entity,
+		Flags:    proto.Int32(streamData),
+	})
+}
+
+// 对端半关闭且已接收完毕时返回io.EOF
+func (s *Stream) Recv() (*StreamMessage, error) {
+	s.mux.Lock()
+	eof := s.eof
+	s.mux.Unlock()
+	if eof {
+		return nil, io.EOF
+	}
+	select {
+	case m := <-s.recv:
+		return s.received(m)
+	default:
+	}
+	select {
+	case m := <-s.recv:
+		return s.received(m)
+	case <-s.ctx.Done():
+		return nil, s.Err()
+	}
+}
+
+func (s *Stream) received(m *StreamMessage) (*StreamMessage, error) {
+	if m == nil {
+		s.mux.Lock()
+		s.eof = true
+		done := s.sendClosed
+		s.mux.Unlock()
+		if done {
+			s.finish()
+		}
+		return nil, io.EOF
+	}
+	if n := atomic.AddInt32(&s.consumed, 1); n >= s.window/2 && atomic.CompareAndSwapInt32(&s.consumed, n, 0) {
+		err := s.c.sendStreamFrame(&pb.StreamFrame{
+			StreamId: &s.id,
+			Credit:   proto.Int32(n),
+		})
+		if err != nil {
+			Logger.Warn("failed stream window update:", s.id, err)
+		}
+	}
+	return m, nil
+}
+
+// 半关闭:不再发送,仍可接收
+func (s *Stream) CloseSend() error {
+	s.mux.Lock()
+	if s.sendClosed || s.err != nil {
+		s.mux.Unlock()
+		return nil
+	}
+	s.sendClosed = true
+	done := s.eof
+	s.mux.Unlock()
+	err := s.c.sendStreamFrame(&pb.StreamFrame{
+		StreamId: &s.id,
+		Flags:    proto.Int32(streamEnd),
+	})
+	if done {
+		s.finish()
+	}
+	return err
+}
+
+// 终止流,通知对端
+func (s *Stream) Close() {
+	s.mux.Lock()
+	if s.err != nil || (s.sendClosed && s.eof) {
+		s.mux.Unlock()
+		return
+	}
+	s.mux.Unlock()
+	s.reset("")
+	s.abort(ErrStreamClosed)
+}
+
+// 流终止的原因,未终止时为nil
+func (s *Stream) Err() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.err == nil && s.ctx.Err() != nil {
+		return ErrStreamClosed
+	}
+	return s.err
+}
+
+func (s *Stream) reset(errmsg string) {
+	err := s.c.sendStreamFrame(&pb.StreamFrame{
+		StreamId: &s.id,
+		Flags:    proto.Int32(streamReset),
+		Errmsg:   &errmsg,
+	})
+	if err != nil {
+		Logger.Warn("failed stream reset:", s.id, err)
+	}
+}
+
+func (s *Stream) abort(err error) {
+	s.mux.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mux.Unlock()
+	s.finish()
+}
+
+func (s *Stream) finish() {
+	s.c.remStream(s.id)
+	s.cancel()
+}
+
+// 通道已断开时返回false,避免abortStreams之后加入的流无人清理
+func (c *Channel) putStream(s *Stream) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if atomic.LoadInt32(&c.valid) != 1 {
+		return false
+	}
+	c.streams[s.id] = s
+	return true
+}
+
+func (c *Channel) remStream(id string) {
+	c.mux.Lock()
+	if _, ok := c.streams[id]; ok {
+		delete(c.streams, id)
+		c.closed[id] = struct{}{}
+		c.closedQ = append(c.closedQ, id)
+		if len(c.closedQ) > recentStreams {
+			delete(c.closed, c.closedQ[0])
+			c.closedQ = c.closedQ[1:]
+		}
+	}
+	c.mux.Unlock()
+}
+
+func (c *Channel) recentlyClosed(id string) bool {
+	c.mux.Lock()
+	_, ok := c.closed[id]
+	c.mux.Unlock()
+	return ok
+}
+
+func (c *Channel) getStream(id string) (s *Stream, ok bool) {
+	c.mux.Lock()
+	s, ok = c.streams[id]
+	c.mux.Unlock()
+	return
+}
+
+func (c *Channel) sendStreamFrame(f *pb.StreamFrame) error {
+	bs, err := proto.Marshal(&pb.Message{Stream: f})
+	if err != nil {
+		return err
+	}
+	return c.Send(bs)
+}
+
+// 在readLoop中调用,不可阻塞,写操作经later进行
+func (c *Channel) handleStreamFrame(f *pb.StreamFrame) {
+	id := f.GetStreamId()
+	flags := f.GetFlags()
+	if flags&streamOpen != 0 {
+		c.acceptStream(f)
+		return
+	}
+	s, ok := c.getStream(id)
+	if !ok {
+		if flags&streamReset == 0 && !c.recentlyClosed(id) {
+			tmp := &Stream{c: c, id: id}
+			c.later(func() { tmp.reset("unknown stream") })
+		}
+		return
+	}
+	if flags&streamReset != 0 {
+		errmsg := f.GetErrmsg()
+		if errmsg == "" {
+			s.abort(ErrStreamClosed)
+		} else {
+			s.abort(errors.New(errmsg))
+		}
+		return
+	}
+	if n := f.GetCredit(); n > 0 {
+		s.win.add(n)
+	}
+	if flags&streamData != 0 {
+		m := &StreamMessage{msg: f}
+		m.dp = m
+		select {
+		case s.recv <- m:
+		default:
+			c.later(func() { s.reset("stream window exceeded") })
+			s.abort(errors.New("stream window exceeded"))
+			return
+		}
+	}
+	if flags&streamEnd != 0 {
+		s.mux.Lock()
+		s.peerEnd = true
+		s.mux.Unlock()
+		select {
+		case s.recv <- nil:
+		default:
+		}
+	}
+}
+
+// 流与请求共用并发限制,处理期间占用一个worker
+func (c *Channel) acceptStream(f *pb.StreamFrame) {
+	s := newStream(c, f.GetStreamId(), f.GetCmd())
+	if !c.authenticated() {
+		s.cancel()
+		c.refuse(func() { s.reset(ErrUnauthenticated.Error()) })
+		return
+	}
+	reject := func(errmsg string) {
+		s.cancel()
+		c.later(func() { s.reset(errmsg) })
+	}
+	h, ok := c.cfg.streamHandlers[s.cmd]
+	if !ok {
+		reject("HANDLER_NOT_FOUND:" + s.cmd)
+		return
+	}
+	atomic.AddInt32(&c.inflight, 1)
+	if atomic.LoadInt32(&c.leaving) != 0 {
+		atomic.AddInt32(&c.inflight, -1)
+		reject("server going away")
+		return
+	}
+	if !c.workers.acquire() {
+		atomic.AddInt32(&c.inflight, -1)
+		reject("QUEUE_FULL")
+		return
+	}
+	if !c.cfg.shared.acquire() {
+		c.workers.release()
+		atomic.AddInt32(&c.inflight, -1)
+		reject("QUEUE_FULL")
+		return
+	}
+	s.win.add(f.GetCredit())
+	if !c.putStream(s) {
+		c.cfg.shared.release()
+		c.workers.release()
+		atomic.AddInt32(&c.inflight, -1)
+		s.cancel()
+		return
+	}
+	go func() {
+		defer atomic.AddInt32(&c.inflight, -1)
+		defer c.workers.release()
+		defer c.cfg.shared.release()
+		if !c.workers.enter(s.ctx) {
+			return
+		}
+		defer c.workers.leave()
+		if !c.cfg.shared.enter(s.ctx) {
+			return
+		}
+		defer c.cfg.shared.leave()
+		err := c.sendStreamFrame(&pb.StreamFrame{
+			StreamId: &s.id,
+			Credit:   &s.window,
+		})
+		if err != nil {
+			s.abort(err)
+			return
+		}
+		h.HandleStream(s)
+		s.CloseSend()
+		s.mux.Lock()
+		drained := s.peerEnd || s.err != nil
+		s.mux.Unlock()
+		if !drained {
+			//对端仍在发送,通知其终止,避免其Send永久阻塞
+			s.reset("")
+		}
+		s.finish()
+	}()
+}
+
+// 通道断开时终止所有流
+func (c *Channel) abortStreams() {
+	c.mux.Lock()
+	ss := make([]*Stream, 0, len(c.streams))
+	for _, s := range c.streams {
+		ss = append(ss, s)
+	}
+	c.mux.Unlock()
+	for _, s := range ss {
+		s.abort(ErrLinkBroken)
+	}
+}
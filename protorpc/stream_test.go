@@ -0,0 +1,216 @@
+package protorpc
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStreamEcho(t *testing.T) {
+	StreamWindow = 4
+	defer func() { StreamWindow = 16 }()
+	s := NewServer(nil)
+	s.HandleStreamFunc("echo", func(st *Stream) {
+		for {
+			m, err := st.Recv()
+			if err != nil {
+				return
+			}
+			v, _ := m.GetInt64("v")
+			o := NewStreamMessage()
+			o.SetInt64("v", v*2)
+			if err := st.Send(o); err != nil {
+				return
+			}
+		}
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	st, err := c.OpenStream("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < 50; i++ {
+			m := NewStreamMessage()
+			m.SetInt64("v", int64(i))
+			if err := st.Send(m); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		st.CloseSend()
+	}()
+	n := 0
+	for {
+		m, err := st.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := m.GetInt64("v"); v != int64(n*2) {
+			t.Fatal(v)
+		}
+		n++
+	}
+	if n != 50 {
+		t.Fatal(n)
+	}
+
+	st2, err := c.OpenStream("nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st2.Recv(); err == nil || err == io.EOF {
+		t.Fatal(err)
+	}
+}
+
+// handler返回后对端仍在途的帧被忽略,不回复unknown stream
+// 处理方未读完即返回时终止流,发送方不会永久阻塞
+func TestStreamLateFrames(t *testing.T) {
+	StreamWindow = 4
+	defer func() { StreamWindow = 16 }()
+	s := NewServer(nil)
+	s.HandleStreamFunc("quit", func(st *Stream) {})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	st, err := c.OpenStream("quit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Recv(); err != io.EOF {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if err := st.Send(NewStreamMessage()); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != ErrStreamClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("send blocked")
+	}
+	if !c.IsValid() {
+		t.Fatal("link broken")
+	}
+}
+
+// 流与请求共用通道的并发限制
+func TestStreamChannelLimit(t *testing.T) {
+	s := NewServer(nil)
+	s.SetChannelLimit(1, 0)
+	s.HandleStreamFunc("hold", func(st *Stream) {
+		st.Recv()
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	st, err := c.OpenStream("hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2, err := c.OpenStream("hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st2.Recv(); err == nil || err.Error() != "QUEUE_FULL" {
+		t.Fatal(err)
+	}
+	st.CloseSend()
+	if _, err := st.Recv(); err != io.EOF {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	st3, err := c.OpenStream("hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st3.CloseSend()
+	if _, err := st3.Recv(); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamsDroppedOnDisconnect(t *testing.T) {
+	s := NewServer(nil)
+	s.HandleStreamFunc("hold", func(st *Stream) {
+		<-st.Context().Done()
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	st, err := c.OpenStream("hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CloseAll()
+	if _, err := st.Recv(); err != ErrLinkBroken {
+		t.Fatal(err)
+	}
+	c.channel.mux.Lock()
+	n := len(c.channel.streams)
+	c.channel.mux.Unlock()
+	if n != 0 {
+		t.Fatal("streams left:", n)
+	}
+	if _, err := c.OpenStream("hold"); err != ErrLinkBroken {
+		t.Fatal(err)
+	}
+}
+
+// 多个goroutine同时接收时窗口计数不竞争
+func TestStreamConcurrentRecv(t *testing.T) {
+	StreamWindow = 4
+	defer func() { StreamWindow = 16 }()
+	s := NewServer(nil)
+	s.HandleStreamFunc("gen", func(st *Stream) {
+		for i := 0; i < 100; i++ {
+			if err := st.Send(NewStreamMessage()); err != nil {
+				return
+			}
+		}
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	st, err := c.OpenStream("gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.CloseSend()
+	counts := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			n := 0
+			for {
+				if _, err := st.Recv(); err != nil {
+					counts <- n
+					return
+				}
+				n++
+			}
+		}()
+	}
+	if n := <-counts + <-counts; n != 100 {
+		t.Fatal(n)
+	}
+}
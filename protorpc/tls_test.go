@@ -0,0 +1,122 @@
+package protorpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// parent为nil时生成自签名证书
+func mkCert(cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		panic(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// 以空闲端口调用按地址监听的Serve*,等待端口可连接
+func serveAddr(t *testing.T, serve func(addr string) error) string {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ls.Addr().String()
+	ls.Close()
+	go serve(addr)
+	for i := 0; i < 100; i++ {
+		if cc, err := net.Dial("tcp", addr); err == nil {
+			cc.Close()
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("not listening:", addr)
+	return ""
+}
+
+func TestTLSPeerCertificates(t *testing.T) {
+	ca, caKey, _ := mkCert("ca", nil, nil, true)
+	_, _, srvCert := mkCert("server", ca, caKey, false)
+	_, _, cliCert := mkCert("client-1", ca, caKey, false)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	s := NewServer(nil)
+	s.SetAuthenticator(TLSAuthenticator(nil))
+	s.HandleFunc("who", func(c *Channel, r *Request) *Response {
+		rsp := NewResponse(r.ReqId(), Result_OK)
+		rsp.SetString("cn", c.PeerCertificates()[0].Subject.CommonName)
+		rsp.SetString("p", c.Principal())
+		return rsp
+	})
+	addr := serveAddr(t, func(addr string) error {
+		return s.ServeTlsWithClientCA(addr, &tls.Config{Certificates: []tls.Certificate{srvCert}}, pool)
+	})
+	defer s.Stop()
+
+	c := NewClient(addr, 0, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cliCert}}, nil)
+	if !c.Serve() {
+		t.Fatal("connect failed")
+	}
+	defer c.Close()
+	st, ok := c.channel.TLSState()
+	if !ok || len(st.PeerCertificates) == 0 || st.PeerCertificates[0].Subject.CommonName != "server" {
+		t.Fatal("tls state", ok)
+	}
+	rsp := c.Execute(NewRequest("who"), 1000)
+	cn, _ := rsp.GetString("cn")
+	p, _ := rsp.GetString("p")
+	if cn != "client-1" || p != "client-1" {
+		t.Fatal(rsp)
+	}
+
+	bad := NewClient(addr, 0, &tls.Config{RootCAs: pool}, nil)
+	if bad.Serve() {
+		t.Fatal("connected without client cert")
+	}
+	bad.Close()
+}
+
+func TestPlainChannelTLSState(t *testing.T) {
+	s := NewServer(nil)
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+	if _, ok := c.channel.TLSState(); ok || c.channel.PeerCertificates() != nil {
+		t.Fatal("plain tcp reports tls")
+	}
+}
+
+// tlsCfg为nil时不panic,因缺少服务端证书返回错误
+func TestClientCANilConfig(t *testing.T) {
+	ca, _, _ := mkCert("ca", nil, nil, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	s := NewServer(nil)
+	if err := s.ServeTlsWithClientCA("127.0.0.1:0", nil, pool); err == nil {
+		t.Fatal("served without certificate")
+	}
+}
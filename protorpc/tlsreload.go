@@ -0,0 +1,156 @@
+package protorpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// 证书更新后新的握手使用新证书,已建立的通道不受影响
+type TlsReloader struct {
+	pem, key, ca string
+	load         func() (*tls.Certificate, *x509.CertPool, error)
+	interval     time.Duration
+
+	mux     sync.Mutex
+	checked time.Time
+	modTime time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+// 每隔interval检查一次文件的修改时间,变化后重新加载;pem/key或ca可为空
+func NewTlsReloader(pem, key, ca string, interval time.Duration) (*TlsReloader, error) {
+	r := &TlsReloader{
+		pem:      pem,
+		key:      key,
+		ca:       ca,
+		interval: interval,
+	}
+	r.load = r.loadFiles
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	r.modTime = r.latestModTime()
+	r.checked = time.Now()
+	return r, nil
+}
+
+// 由load提供证书,调用Reload时重新加载
+func NewTlsReloaderFunc(load func() (*tls.Certificate, *x509.CertPool, error)) (*TlsReloader, error) {
+	r := &TlsReloader{load: load}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *TlsReloader) Reload() error {
+	cert, pool, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.mux.Lock()
+	r.cert = cert
+	r.pool = pool
+	r.mux.Unlock()
+	return nil
+}
+
+func (r *TlsReloader) loadFiles() (cert *tls.Certificate, pool *x509.CertPool, err error) {
+	if r.pem != "" {
+		var kp tls.Certificate
+		if kp, err = tls.LoadX509KeyPair(r.pem, r.key); err != nil {
+			return
+		}
+		cert = &kp
+	}
+	if r.ca != "" {
+		if pool, err = loadCertPool(r.ca); err != nil {
+			return
+		}
+	}
+	if cert == nil && pool == nil {
+		err = errors.New("no certificate file")
+	}
+	return
+}
+
+func (r *TlsReloader) latestModTime() (t time.Time) {
+	for _, f := range []string{r.pem, r.key, r.ca} {
+		if f == "" {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return
+}
+
+func (r *TlsReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mux.Lock()
+	if r.interval <= 0 || time.Since(r.checked) < r.interval {
+		cert, pool := r.cert, r.pool
+		r.mux.Unlock()
+		return cert, pool
+	}
+	r.checked = time.Now()
+	last := r.modTime
+	r.mux.Unlock()
+	if t := r.latestModTime(); t.After(last) {
+		if err := r.Reload(); err != nil {
+			Logger.Error("reload certificate failed:", err)
+		} else {
+			Logger.Info("certificate reloaded:", r.pem, r.ca)
+			r.mux.Lock()
+			r.modTime = t
+			r.mux.Unlock()
+		}
+	}
+	r.mux.Lock()
+	cert, pool := r.cert, r.pool
+	r.mux.Unlock()
+	return cert, pool
+}
+
+// 服务端每次握手时取当前的证书,设置了ca时要求客户端证书
+func (r *TlsReloader) serverConfig(base *tls.Config) *tls.Config {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, pool := r.current()
+		c := cfg.Clone()
+		c.GetConfigForClient = nil
+		if cert != nil {
+			c.Certificates = []tls.Certificate{*cert}
+		}
+		if pool != nil {
+			c.ClientCAs = pool
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return c, nil
+	}
+	return cfg
+}
+
+// 客户端每次拨号时取当前的证书及ca
+func (r *TlsReloader) clientConfig(base *tls.Config) *tls.Config {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	cert, pool := r.current()
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	if pool != nil {
+		cfg.RootCAs = pool
+	}
+	return cfg
+}
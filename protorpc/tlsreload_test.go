@@ -0,0 +1,107 @@
+package protorpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePem(t *testing.T, dir string, c tls.Certificate) {
+	kb, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "c.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "k.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb}), 0600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "c.pem"), future, future)
+}
+
+func peerCN(c *Client) string {
+	st, ok := c.channel.TLSState()
+	if !ok || len(st.PeerCertificates) == 0 {
+		return ""
+	}
+	return st.PeerCertificates[0].Subject.CommonName
+}
+
+// 文件更新后新连接使用新证书,已有连接不受影响
+func TestTlsReloaderFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, _ := mkCert("ca", nil, nil, true)
+	_, _, c1 := mkCert("v1", ca, caKey, false)
+	writePem(t, dir, c1)
+	r, err := NewTlsReloader(filepath.Join(dir, "c.pem"), filepath.Join(dir, "k.pem"), "", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(nil)
+	addr := serveAddr(t, func(addr string) error { return s.ServeTlsWithReloader(addr, nil, r) })
+	defer s.Stop()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	a := NewClient(addr, 0, &tls.Config{RootCAs: pool}, nil)
+	if !a.Serve() || peerCN(a) != "v1" {
+		t.Fatal("v1")
+	}
+	defer a.Close()
+	_, _, c2 := mkCert("v2", ca, caKey, false)
+	writePem(t, dir, c2)
+	time.Sleep(30 * time.Millisecond)
+	b := NewClient(addr, 0, &tls.Config{RootCAs: pool}, nil)
+	if !b.Serve() || peerCN(b) != "v2" {
+		t.Fatal("v2")
+	}
+	defer b.Close()
+	if !a.IsValid() {
+		t.Fatal("old channel dropped")
+	}
+}
+
+func TestTlsReloaderFunc(t *testing.T) {
+	ca, caKey, _ := mkCert("ca", nil, nil, true)
+	_, _, srv := mkCert("server", ca, caKey, false)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	cn := "client-1"
+	cr, err := NewTlsReloaderFunc(func() (*tls.Certificate, *x509.CertPool, error) {
+		_, _, c := mkCert(cn, ca, caKey, false)
+		return &c, pool, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(nil)
+	s.SetAuthenticator(TLSAuthenticator(nil))
+	addr := serveAddr(t, func(addr string) error {
+		return s.ServeTlsWithClientCA(addr, &tls.Config{Certificates: []tls.Certificate{srv}}, pool)
+	})
+	defer s.Stop()
+
+	for _, want := range []string{"client-1", "client-2"} {
+		cn = want
+		if err := cr.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		c := NewClient(addr, 0, nil, nil)
+		c.SetTlsReloader(cr)
+		if !c.Serve() {
+			t.Fatal("connect failed")
+		}
+		time.Sleep(20 * time.Millisecond)
+		found := false
+		for _, ch := range s.Channels() {
+			found = found || ch.Principal() == want
+		}
+		c.Close()
+		if !found {
+			t.Fatal("principal", want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package protorpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	OrderNone    = iota //请求并发处理
+	OrderChannel        //同一通道的请求按到达顺序依次处理
+	OrderCommand        //同一通道中相同命令的请求按到达顺序依次处理
+)
+
+// 限制并发处理的请求数及排队数,超出时请求以Result_QUEUE_FULL拒绝
+type workers struct {
+	sem        chan struct{}
+	pending    int32
+	maxPending int32
+}
+
+// concurrency为0时不限制,返回nil
+func newWorkers(concurrency, queueSize int) *workers {
+	if concurrency <= 0 {
+		return nil
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return &workers{
+		sem:        make(chan struct{}, concurrency),
+		maxPending: int32(concurrency + queueSize),
+	}
+}
+
+func (w *workers) acquire() bool {
+	if w == nil {
+		return true
+	}
+	if atomic.AddInt32(&w.pending, 1) > w.maxPending {
+		atomic.AddInt32(&w.pending, -1)
+		return false
+	}
+	return true
+}
+
+func (w *workers) release() {
+	if w != nil {
+		atomic.AddInt32(&w.pending, -1)
+	}
+}
+
+// 等待空闲位置,ctx结束时放弃
+func (w *workers) enter(ctx context.Context) bool {
+	if w == nil {
+		return true
+	}
+	select {
+	case w.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (w *workers) leave() {
+	if w != nil {
+		<-w.sem
+	}
+}
+
+// 按加入顺序依次执行,空闲时不占用goroutine
+type serialQueue struct {
+	mux     sync.Mutex
+	jobs    []func()
+	running bool
+}
+
+func (q *serialQueue) push(job func()) {
+	q.mux.Lock()
+	q.jobs = append(q.jobs, job)
+	if q.running {
+		q.mux.Unlock()
+		return
+	}
+	q.running = true
+	q.mux.Unlock()
+	go q.run()
+}
+
+func (q *serialQueue) run() {
+	for {
+		q.mux.Lock()
+		if len(q.jobs) == 0 {
+			q.running = false
+			q.mux.Unlock()
+			return
+		}
+		job := q.jobs[0]
+		q.jobs[0] = nil
+		q.jobs = q.jobs[1:]
+		q.mux.Unlock()
+		job()
+	}
+}
+
+// Server与Client共用的通道配置
+type channelConfig struct {
+	concurrency int //单个通道的并发数,0不限制
+	queueSize   int //单个通道的排队数
+	order       int
+	shared      *workers
+
+	interceptors     []Interceptor
+	callInterceptors []CallInterceptor
+	streamHandlers   map[string]StreamHandler
+	codecs           []string //支持的压缩算法,按优先顺序
+	auth             Authenticator
+	credentials      Credentials
+	idem             *idemCache
+}
+
+func (cfg *channelConfig) handleStream(cmd string, h StreamHandler) {
+	if cfg.streamHandlers == nil {
+		cfg.streamHandlers = make(map[string]StreamHandler)
+	}
+	if _, ok := cfg.streamHandlers[cmd]; ok {
+		panic("multi stream handler for command:" + cmd)
+	}
+	cfg.streamHandlers[cmd] = h
+}
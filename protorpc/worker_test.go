@@ -0,0 +1,177 @@
+package protorpc
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkersAcquire(t *testing.T) {
+	if w := newWorkers(0, 10); w != nil || !w.acquire() {
+		t.Fatal("zero concurrency should not limit")
+	}
+	w := newWorkers(1, 1)
+	if !w.acquire() || !w.acquire() {
+		t.Fatal("within limit")
+	}
+	if w.acquire() {
+		t.Fatal("over limit")
+	}
+	w.release()
+	if !w.acquire() {
+		t.Fatal("released")
+	}
+}
+
+func TestChannelLimit(t *testing.T) {
+	s := NewServer(nil)
+	s.SetChannelLimit(1, 1)
+	s.HandleFunc("slow", func(c *Channel, r *Request) *Response {
+		time.Sleep(300 * time.Millisecond)
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	res := map[int32]int{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := c.Execute(NewRequest("slow"), 2000)
+			mu.Lock()
+			res[r.Result()]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if res[Result_OK] != 2 || res[Result_QUEUE_FULL] != 2 {
+		t.Fatal(res)
+	}
+}
+
+// 大量并发请求被拒绝时连接保持可用
+func TestChannelLimitBurst(t *testing.T) {
+	s := NewServer(nil)
+	s.SetChannelLimit(1, 0)
+	s.HandleFunc("slow", func(c *Channel, r *Request) *Response {
+		time.Sleep(100 * time.Millisecond)
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	res := map[int32]int{}
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := c.Execute(NewRequest("slow"), 5000)
+			mu.Lock()
+			res[r.Result()]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if res[Result_OK] == 0 || res[Result_QUEUE_FULL] == 0 || res[Result_OK]+res[Result_QUEUE_FULL] != 200 {
+		t.Fatal(res)
+	}
+	if !c.IsValid() || s.ChannelCount() != 1 {
+		t.Fatal("link broken")
+	}
+}
+
+func TestServerLimitShared(t *testing.T) {
+	s := NewServer(nil)
+	s.SetLimit(1, 0)
+	s.HandleFunc("slow", func(c *Channel, r *Request) *Response {
+		time.Sleep(200 * time.Millisecond)
+		return NewResponse(r.ReqId(), Result_OK)
+	})
+	addr := serve(t, s)
+	defer s.Stop()
+	c1 := connect(t, addr)
+	defer c1.Close()
+	c2 := connect(t, addr)
+	defer c2.Close()
+
+	done := make(chan *Response, 1)
+	go func() { done <- c1.Execute(NewRequest("slow"), 2000) }()
+	time.Sleep(50 * time.Millisecond)
+	if r := c2.Execute(NewRequest("slow"), 2000); r.Result() != Result_QUEUE_FULL {
+		t.Fatal(r)
+	}
+	if r := <-done; !r.IsOK() {
+		t.Fatal(r)
+	}
+}
+
+func TestOrderChannel(t *testing.T) {
+	s := NewServer(nil)
+	s.SetOrder(OrderChannel)
+	got := make(chan int64, 100)
+	s.HandleFunc("seq", func(c *Channel, r *Request) *Response {
+		time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		v, _ := r.GetInt64("v")
+		got <- v
+		return nil
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		r := NewRequest("seq")
+		r.SetInt64("v", int64(i))
+		c.Notice(r)
+	}
+	for i := 0; i < 100; i++ {
+		if v := <-got; v != int64(i) {
+			t.Fatal(i, v)
+		}
+	}
+}
+
+// 不同命令之间不互相等待
+func TestOrderCommand(t *testing.T) {
+	s := NewServer(nil)
+	s.SetOrder(OrderCommand)
+	release := make(chan struct{})
+	got := make(chan string, 3)
+	s.HandleFunc("a", func(c *Channel, r *Request) *Response {
+		v, _ := r.GetString("v")
+		if v == "a1" {
+			<-release
+		}
+		got <- v
+		return nil
+	})
+	s.HandleFunc("b", func(c *Channel, r *Request) *Response {
+		got <- "b"
+		return nil
+	})
+	c := connect(t, serve(t, s))
+	defer s.Stop()
+	defer c.Close()
+
+	for _, v := range []string{"a1", "a2"} {
+		r := NewRequest("a")
+		r.SetString("v", v)
+		c.Notice(r)
+	}
+	c.Notice(NewRequest("b"))
+	if v := <-got; v != "b" {
+		t.Fatal(v)
+	}
+	close(release)
+	if a1, a2 := <-got, <-got; a1 != "a1" || a2 != "a2" {
+		t.Fatal(a1, a2)
+	}
+}
@@ -43,7 +43,7 @@ func (c *clientListener) OnConnected(ch *protorpc.Channel) {
 		r.SetString("group", c.group)
 		if rsp := c.Execute(r, 2000); !rsp.IsOK() {
 			protorpc.Logger.Errorf("regist [%s,%s] failed:%s", c.group, c.id, rsp.String())
-			c.Close()
+			ch.Close() //Client.Close不再重连,仅断开当前连接
 			<-time.After(time.Second)
 			return
 		}